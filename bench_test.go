@@ -0,0 +1,285 @@
+package prometheusremotewritev2
+
+import (
+	"io"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"prometheusrwexporter-demo/otlpgen"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// benchWorkloads are generated exporter batches of increasing size, one series per metric.
+// The builder only converts exponential histograms, so that is all they hold: every point has
+// a dozen buckets, so the remote write 1.0 comparisons weigh labels against histograms of a
+// realistic size, but they say nothing about samples of gauges and counters.
+var benchWorkloads = []struct {
+	name               string
+	resources, metrics int
+	attributes, points int
+	resourceAttributes int
+	labelValueLength   int
+}{
+	{name: "small", resources: 1, metrics: 10, attributes: 3, points: 1, resourceAttributes: 5},
+	{name: "medium", resources: 10, metrics: 50, attributes: 5, points: 2, resourceAttributes: 10, labelValueLength: 16},
+	{name: "large", resources: 100, metrics: 100, attributes: 10, points: 5, resourceAttributes: 20, labelValueLength: 32},
+}
+
+func generateWorkload(tb testing.TB, i int) pmetric.Metrics {
+	w := benchWorkloads[i]
+	cfg := otlpgen.DefaultConfig()
+	cfg.Resources = w.resources
+	cfg.ResourceAttributes = w.resourceAttributes
+	cfg.Gauges, cfg.Sums, cfg.Histograms, cfg.Summaries = 0, 0, 0, 0
+	cfg.ExponentialHistograms = w.metrics
+	cfg.SeriesPerMetric = 1
+	cfg.Attributes = w.attributes
+	cfg.LabelValueLength = w.labelValueLength
+	cfg.DataPointsPerSeries = w.points
+	md, err := otlpgen.Generate(cfg)
+	require.NoError(tb, err)
+	return md
+}
+
+// forEachWorkload runs fn as a sub-benchmark of every workload, with the builder the
+// workload was added to.
+func forEachWorkload(b *testing.B, fn func(b *testing.B, builder *V2WriteRequestBuilder)) {
+	for i, w := range benchWorkloads {
+		md := generateWorkload(b, i)
+		b.Run(w.name, func(b *testing.B) {
+			builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+			require.NoError(b, err)
+			builder.Add(md)
+			fn(b, builder)
+		})
+	}
+}
+
+// buildRequest builds the request of the builder and its remote write 1.0 equivalent.
+func buildRequest(b *testing.B, builder *V2WriteRequestBuilder) (*typesv2.Request, *prompb.WriteRequest) {
+	req, err := builder.Build()
+	require.NoError(b, err)
+	v1 := &prompb.WriteRequest{}
+	for _, ts := range builder.tsSlice {
+		series := prompb.TimeSeries{Labels: ts.labelSet}
+		for _, h := range ts.histograms {
+			series.Histograms = append(series.Histograms, V2ToV1Histogram(h))
+		}
+		v1.Timeseries = append(v1.Timeseries, series)
+	}
+	return req, v1
+}
+
+func reportPerSeries(b *testing.B, size, series int, unit string) {
+	b.ReportMetric(float64(size)/float64(series), unit)
+}
+
+func BenchmarkSymbolize(b *testing.B) {
+	forEachWorkload(b, func(b *testing.B, builder *V2WriteRequestBuilder) {
+		_, _ = buildRequest(b, builder)
+		var strs []string
+		for _, ts := range builder.tsSlice {
+			for _, l := range ts.labelSet {
+				strs = append(strs, l.Name, l.Value)
+			}
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			symbols := NewSymbolsTable()
+			for _, s := range strs {
+				symbols.Symbolize(s)
+			}
+		}
+	})
+}
+
+func BenchmarkSymbolizeLabelRefs(b *testing.B) {
+	forEachWorkload(b, func(b *testing.B, builder *V2WriteRequestBuilder) {
+		_, _ = buildRequest(b, builder)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			symbols := NewSymbolsTable()
+			for _, ts := range builder.tsSlice {
+				symbolizeLabelRefs(&symbols, ts.labelSet)
+			}
+		}
+	})
+}
+
+// BenchmarkCreateRequest measures the steady state of a builder reused for batches of the
+// same shape.
+func BenchmarkCreateRequest(b *testing.B) {
+	forEachWorkload(b, func(b *testing.B, builder *V2WriteRequestBuilder) {
+		builder.CreateRequest()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			builder.CreateRequest()
+		}
+		reportPerSeries(b, int(b.Elapsed().Nanoseconds())/b.N, len(builder.request.Timeseries), "ns/series")
+	})
+}
+
+// BenchmarkMarshal compares the protobuf encoding of the request with its remote write 1.0
+// equivalent, reporting the size of both.
+func BenchmarkMarshal(b *testing.B) {
+	forEachWorkload(b, func(b *testing.B, builder *V2WriteRequestBuilder) {
+		v2, v1 := buildRequest(b, builder)
+		for _, proto := range []struct {
+			name    string
+			marshal func() ([]byte, error)
+		}{
+			{"v2", v2.Marshal},
+			{"v1", v1.Marshal},
+		} {
+			b.Run(proto.name, func(b *testing.B) {
+				var pBuf []byte
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					var err error
+					if pBuf, err = proto.marshal(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.SetBytes(int64(len(pBuf)))
+				reportPerSeries(b, len(pBuf), len(v2.Timeseries), "bytes/series")
+			})
+		}
+	})
+}
+
+// BenchmarkCompress compares the snappy compression of the request with its remote write
+// 1.0 equivalent, reporting the compressed size of both.
+func BenchmarkCompress(b *testing.B) {
+	forEachWorkload(b, func(b *testing.B, builder *V2WriteRequestBuilder) {
+		v2, v1 := buildRequest(b, builder)
+		v2Buf, err := v2.Marshal()
+		require.NoError(b, err)
+		v1Buf, err := v1.Marshal()
+		require.NoError(b, err)
+		for _, proto := range []struct {
+			name string
+			pBuf []byte
+		}{
+			{"v2", v2Buf},
+			{"v1", v1Buf},
+		} {
+			b.Run(proto.name, func(b *testing.B) {
+				buf := make([]byte, snappy.MaxEncodedLen(len(proto.pBuf)))
+				var compressed []byte
+				b.ReportAllocs()
+				b.SetBytes(int64(len(proto.pBuf)))
+				for i := 0; i < b.N; i++ {
+					compressed = snappy.Encode(buf, proto.pBuf)
+				}
+				reportPerSeries(b, len(compressed), len(v2.Timeseries), "bytes/series")
+				b.ReportMetric(float64(len(compressed))/float64(len(proto.pBuf)), "ratio")
+			})
+		}
+	})
+}
+
+// BenchmarkCompactSymbols measures the compaction of the symbols table of the request,
+// reporting the bytes it saves per series, before and after snappy compression.
+func BenchmarkCompactSymbols(b *testing.B) {
+	forEachWorkload(b, func(b *testing.B, builder *V2WriteRequestBuilder) {
+		req, _ := buildRequest(b, builder)
+		before, err := req.Marshal()
+		require.NoError(b, err)
+		var c symbolsCompactor
+		stats := c.compact(req, true)
+		after, err := req.Marshal()
+		require.NoError(b, err)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// Compacting the compacted request again does the same work.
+			c.compact(req, false)
+		}
+		reportPerSeries(b, stats.Saved(), len(req.Timeseries), "saved-bytes/series")
+		reportPerSeries(b, len(snappy.Encode(nil, before))-len(snappy.Encode(nil, after)), len(req.Timeseries), "saved-snappy-bytes/series")
+	})
+}
+
+// TestBenchWorkloadsConvert makes sure every series of the benchmark workloads is converted,
+// so that the benchmarks measure what they claim to.
+func TestBenchWorkloadsConvert(t *testing.T) {
+	for i, w := range benchWorkloads {
+		req, err := RequestFromMetrics(generateWorkload(t, i), RequestLimits{})
+		require.NoError(t, err, w.name)
+		require.Len(t, req.Timeseries, w.resources*w.metrics, w.name)
+		for _, ts := range req.Timeseries {
+			require.Len(t, ts.Histograms, w.points, w.name)
+			require.NotEmpty(t, ts.Histograms[0].PositiveDeltas, "%s: histograms should have their buckets", w.name)
+		}
+	}
+}
+
+// BenchmarkEncodeRequest compares the memory needed to encode a batch by building the
+// request then marshalling it with streaming it, from a fresh builder every time.
+func BenchmarkEncodeRequest(b *testing.B) {
+	for i, w := range benchWorkloads {
+		md := generateWorkload(b, i)
+		b.Run(w.name+"/build", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req, err := RequestFromMetrics(md, RequestLimits{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := req.Marshal(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(w.name+"/stream", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				builder.Add(md)
+				rw, err := NewRequestWriter(io.Discard, "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := builder.Stream(rw); err != nil {
+					b.Fatal(err)
+				}
+				if err := rw.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCreateRequestParallel compares the conversion of the large workload on a single
+// goroutine with its conversion on every core.
+func BenchmarkCreateRequestParallel(b *testing.B) {
+	md := generateWorkload(b, len(benchWorkloads)-1)
+	for _, workers := range []int{1, 0} {
+		name := "serial"
+		if workers == 0 {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			builder, err := NewV2WriteRequestBuilder(httpClientConfig{ConversionWorkers: workers})
+			require.NoError(b, err)
+			builder.Add(md)
+			builder.CreateRequest()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				builder.CreateRequest()
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package prometheusremotewritev2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"go.uber.org/multierr"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+const (
+	remoteWriteVersionHeader = "X-Prometheus-Remote-Write-Version"
+	remoteWriteVersion2      = "2.0.0"
+	contentTypeV2            = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+
+	// maxErrMsgLen caps how much of an error response body ends up in the error.
+	maxErrMsgLen = 1024
+)
+
+// httpClientConfig holds everything needed to reach the remote write endpoint.
+type httpClientConfig struct {
+	Endpoint string
+	Timeout  time.Duration
+	Headers  map[string]string
+	Retry    RetryConfig
+	// Limits is what the endpoint accepts in a single request, larger ones are split.
+	Limits RequestLimits
+	// ConversionWorkers is the number of goroutines converting a batch; see Config.
+	ConversionWorkers int
+	SeriesOrder       SeriesOrder
+	// CompactSymbols orders the symbols tables of the requests by frequency; see
+	// CompactSymbols.
+	CompactSymbols bool
+}
+
+// snappyEncoder is the encoding mandated by the spec: protobuf, then snappy block format.
+type snappyEncoder struct{}
+
+func (snappyEncoder) Encode(req *typesv2.Request) ([]byte, error) {
+	pBuf, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, pBuf), nil
+}
+
+func (snappyEncoder) Decode(data []byte) (*typesv2.Request, error) {
+	pBuf, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	var req typesv2.Request
+	if err := req.Unmarshal(pBuf); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Create a HTTP client with the HTTP Config
+func (builder *V2WriteRequestBuilder) createHTTPClient() {
+	builder.httpClient = &http.Client{Timeout: builder.httpClientConfig.Timeout}
+}
+
+// Send the request to a remote endpoint, retrying recoverable failures as configured. The
+// request is split first if it exceeds the limits of the endpoint.
+func (builder *V2WriteRequestBuilder) send(ctx context.Context) error {
+	if builder.httpClient == nil {
+		builder.createHTTPClient()
+	}
+	// Series too large for a request are reported along with the outcome of the others.
+	requests, dropped := splitRequest(&builder.request, builder.httpClientConfig.Limits)
+	if requests == nil && dropped != nil {
+		return fmt.Errorf("splitting request: %w", dropped)
+	}
+	for i := range requests {
+		body, err := builder.encoder.Encode(&requests[i])
+		if err != nil {
+			return multierr.Append(dropped, fmt.Errorf("encoding request: %w", err))
+		}
+		if err := sendEncoded(ctx, builder.httpClient, builder.httpClientConfig, body); err != nil {
+			return multierr.Append(dropped, err)
+		}
+	}
+	return dropped
+}
+
+func sendEncoded(ctx context.Context, client *http.Client, cfg httpClientConfig, body []byte) error {
+	return retry(ctx, cfg.Retry, func(ctx context.Context) (int, error) {
+		return postOnce(ctx, client, cfg, body)
+	})
+}
+
+func postOnce(ctx context.Context, client *http.Client, cfg httpClientConfig, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", contentTypeV2)
+	req.Header.Set(remoteWriteVersionHeader, remoteWriteVersion2)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Anything that failed before we got a response, DNS, connection resets, timeouts, is
+		// worth another try.
+		return 0, recoverableError{error: err}
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrMsgLen))
+	return resp.StatusCode, classifyResponse(resp, string(bytes.TrimSpace(msg)))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/golang/snappy"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	prw "prometheusrwexporter-demo"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// payloadExtensions are the file extensions of the output formats.
+var payloadExtensions = map[string]string{
+	"proto":  ".pb",
+	"snappy": ".snappy",
+	"json":   ".json",
+}
+
+// otlpInput is an OTLP export request read from source, the index-th in it.
+type otlpInput struct {
+	source string
+	index  int
+	req    pmetricotlp.ExportRequest
+}
+
+// runConvert reads OTLP export requests, either JSON lines or protobuf files, converts each
+// of them into a remote write 2.0 request and writes the payloads out.
+func runConvert(args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	inFormat := fs.String("in", "auto", "input format: json (OTLP JSON, one export request per line), proto (one OTLP protobuf export request per file) or auto, by file extension")
+	outFormat := fs.String("format", "snappy", "output format: proto, snappy (the payload as sent) or json")
+	outDir := fs.String("out", "", "directory to write the payloads to, one file per export request, created if missing; standard output if empty")
+	compact := fs.Bool("compact-symbols", false, "order the symbols table by number of references and drop unused symbols")
+	var limits prw.RequestLimits
+	fs.IntVar(&limits.MaxLabelNameLength, "max-label-name-length", 0, "truncate longer label names, 0 for no limit")
+	fs.IntVar(&limits.MaxLabelValueLength, "max-label-value-length", 0, "truncate longer label values, 0 for no limit")
+	fs.Usage = func() {
+		fmt.Fprintln(stdio.err, "usage: rw2tool convert [flags] [files]\n\nReads standard input, as JSON lines, when no file is given.\n\nflags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, ok := payloadExtensions[*outFormat]; !ok {
+		return fmt.Errorf("unknown output format %q", *outFormat)
+	}
+
+	inputs, err := readOTLPInputs(fs.Args(), *inFormat, stdio.in)
+	if err != nil {
+		return err
+	}
+	if *outDir == "" && *outFormat != "json" && len(inputs) > 1 {
+		return fmt.Errorf("%d binary payloads can't be told apart on standard output, write them to a directory with -out", len(inputs))
+	}
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	for _, in := range inputs {
+		req, err := prw.RequestFromMetrics(in.req.Metrics(), limits)
+		if req == nil {
+			return err
+		}
+		if err != nil {
+			// The request holds everything else, which is still worth looking at.
+			fmt.Fprintf(stdio.err, "%s #%d: %v\n", in.source, in.index, err)
+		}
+		if *compact {
+			if _, err := prw.CompactSymbols(req); err != nil {
+				return fmt.Errorf("%s #%d: %w", in.source, in.index, err)
+			}
+		}
+		payload, err := encodePayload(req, *outFormat)
+		if err != nil {
+			return fmt.Errorf("%s #%d: %w", in.source, in.index, err)
+		}
+
+		if *outDir == "" {
+			if _, err := stdio.out.Write(payload); err != nil {
+				return err
+			}
+			continue
+		}
+		base := strings.TrimSuffix(filepath.Base(in.source), filepath.Ext(in.source))
+		name := filepath.Join(*outDir, fmt.Sprintf("%s-%d%s", base, in.index, payloadExtensions[*outFormat]))
+		if err := os.WriteFile(name, payload, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readOTLPInputs(files []string, format string, stdin io.Reader) ([]otlpInput, error) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var inputs []otlpInput
+	for _, file := range files {
+		var (
+			data []byte
+			err  error
+		)
+		source := file
+		if file == "-" {
+			source = "stdin"
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fileFormat := format
+		if fileFormat == "auto" {
+			fileFormat = "proto"
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".json", ".jsonl", ".ndjson":
+				fileFormat = "json"
+			}
+			if file == "-" {
+				fileFormat = "json"
+			}
+		}
+
+		switch fileFormat {
+		case "json":
+			reqs, err := readJSONLines(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+			for i, req := range reqs {
+				inputs = append(inputs, otlpInput{source: source, index: i, req: req})
+			}
+		case "proto":
+			req := pmetricotlp.NewExportRequest()
+			if err := req.UnmarshalProto(data); err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+			inputs = append(inputs, otlpInput{source: source, req: req})
+		default:
+			return nil, fmt.Errorf("unknown input format %q", fileFormat)
+		}
+	}
+	return inputs, nil
+}
+
+// readJSONLines reads an OTLP JSON export request per line, skipping blank lines.
+func readJSONLines(data []byte) ([]pmetricotlp.ExportRequest, error) {
+	var reqs []pmetricotlp.ExportRequest
+	r := bufio.NewReader(bytes.NewReader(data))
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			req := pmetricotlp.NewExportRequest()
+			if err := req.UnmarshalJSON(trimmed); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			reqs = append(reqs, req)
+		}
+		if errors.Is(err, io.EOF) {
+			return reqs, nil
+		}
+	}
+}
+
+func encodePayload(req *typesv2.Request, format string) ([]byte, error) {
+	if format == "json" {
+		var buf bytes.Buffer
+		if err := (&jsonpb.Marshaler{}).Marshal(&buf, req); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	}
+	pBuf, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if format == "snappy" {
+		return snappy.Encode(nil, pBuf), nil
+	}
+	return pBuf, nil
+}
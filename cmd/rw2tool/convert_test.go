@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	prw "prometheusrwexporter-demo"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// otlpJSONLines returns n OTLP JSON export requests, one per line.
+func otlpJSONLines(t *testing.T, n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		line, err := prw.PrepareDummyExportRequest().MarshalJSON()
+		require.NoError(t, err)
+		buf.Write(line)
+		buf.WriteString("\n\n")
+	}
+	return buf.Bytes()
+}
+
+func TestConvertJSONLinesToFiles(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "capture.jsonl")
+	require.NoError(t, os.WriteFile(input, otlpJSONLines(t, 2), 0o644))
+	// The output directory is created as needed.
+	out := filepath.Join(dir, "out", "snappy")
+
+	var stdout, stderr bytes.Buffer
+	err := runConvert([]string{"-format", "snappy", "-out", out, input}, stdio{out: &stdout, err: &stderr})
+	require.NoError(t, err)
+	assert.Empty(t, stderr.String())
+
+	for _, name := range []string{"capture-0.snappy", "capture-1.snappy"} {
+		payload, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err)
+		reader, err := prw.DecodeRequest(payload)
+		require.NoError(t, err)
+		assert.Equal(t, 5, reader.Len())
+	}
+}
+
+func TestConvertProtoToJSON(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "capture.pb")
+	pBuf, err := prw.PrepareDummyExportRequest().MarshalProto()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(input, pBuf, 0o644))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, runConvert([]string{"-format", "json", input}, stdio{out: &stdout, err: &stderr}))
+
+	var req typesv2.Request
+	require.NoError(t, jsonpb.Unmarshal(&stdout, &req))
+	assert.Len(t, req.Timeseries, 5)
+}
+
+func TestConvertCompactsSymbols(t *testing.T) {
+	// The dummy request is stamped with the current time, both conversions need the same one.
+	input := otlpJSONLines(t, 1)
+	var plain, compacted, stderr bytes.Buffer
+	require.NoError(t, runConvert([]string{"-format", "proto"}, stdio{in: bytes.NewReader(input), out: &plain, err: &stderr}))
+	require.NoError(t, runConvert([]string{"-format", "proto", "-compact-symbols"}, stdio{in: bytes.NewReader(input), out: &compacted, err: &stderr}))
+
+	var before, after typesv2.Request
+	require.NoError(t, before.Unmarshal(plain.Bytes()))
+	require.NoError(t, after.Unmarshal(compacted.Bytes()))
+	diffs, err := prw.DiffRequests(&before, &after)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+	assert.LessOrEqual(t, compacted.Len(), plain.Len())
+}
+
+func TestConvertRefusesSeveralBinaryPayloadsOnStdout(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := runConvert([]string{"-format", "proto"}, stdio{in: bytes.NewReader(otlpJSONLines(t, 2)), out: &stdout, err: &stderr})
+	assert.ErrorContains(t, err, "-out")
+	assert.Empty(t, stdout.Bytes())
+
+	err = runConvert(nil, stdio{in: strings.NewReader("{not json"), out: &stdout, err: &stderr})
+	assert.ErrorContains(t, err, "stdin: line 1")
+
+	err = runConvert([]string{"-in", "xml"}, stdio{in: bytes.NewReader(otlpJSONLines(t, 1)), out: &stdout, err: &stderr})
+	assert.EqualError(t, err, `unknown input format "xml"`)
+}
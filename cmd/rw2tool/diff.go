@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+
+	prw "prometheusrwexporter-demo"
+)
+
+// runDiff prints the semantic differences between two payloads, failing if there are any.
+func runDiff(args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	encoding := fs.String("encoding", "auto", "payload encoding: snappy, raw (protobuf) or auto")
+	fs.Usage = func() {
+		fmt.Fprintln(stdio.err, "usage: rw2tool diff [flags] old new\n\nSeries are matched by label set, whatever the order of the symbols.\n\nflags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected two payloads, got %d", fs.NArg())
+	}
+
+	var readers [2]*prw.RequestReader
+	for i, file := range fs.Args() {
+		payload, err := readPayload(file, stdio.in)
+		if err != nil {
+			return err
+		}
+		if readers[i], err = decodePayload(payload, *encoding); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	diffs, err := prw.DiffRequests(readers[0].Request(), readers[1].Request())
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(stdio.out)
+	for _, d := range diffs {
+		fmt.Fprintln(w, d)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d difference(s)", len(diffs))
+	}
+	return nil
+}
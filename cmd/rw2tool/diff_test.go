@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, payload []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, payload, 0o644))
+		return path
+	}
+	req := testRequest()
+	pBuf, err := req.Marshal()
+	require.NoError(t, err)
+	old := write("old.pb", pBuf)
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, runDiff([]string{old, write("same.snappy", snappy.Encode(nil, pBuf))}, stdio{out: &stdout, err: &stderr}))
+	assert.Empty(t, stdout.String())
+
+	req.Timeseries[0].Samples[0].Value = 43
+	pBuf, err = req.Marshal()
+	require.NoError(t, err)
+	err = runDiff([]string{old, write("new.pb", pBuf)}, stdio{out: &stdout, err: &stderr})
+	assert.EqualError(t, err, "1 difference(s)")
+	assert.Equal(t, "~ {__name__=\"http_requests_total\", job=\"api\"} sample@1000: 42 -> 43\n", stdout.String())
+
+	assert.Error(t, runDiff([]string{old}, stdio{out: &stdout, err: &stderr}))
+}
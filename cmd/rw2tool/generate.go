@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"prometheusrwexporter-demo/otlpgen"
+)
+
+// runGenerate writes synthetic OTLP export requests, one per batch, as JSON lines that
+// convert reads, or protobuf files.
+func runGenerate(args []string, stdio stdio) error {
+	cfg := otlpgen.DefaultConfig()
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	batches := fs.Int("batches", 1, "number of export requests to generate")
+	outFormat := fs.String("format", "json", "output format: json (one export request per line) or proto (one file per export request)")
+	outDir := fs.String("out", "", "directory to write the requests to, one file per request; standard output if empty")
+	temporality := fs.String("temporality", "cumulative", "temporality of sums and histograms: cumulative or delta")
+	fs.IntVar(&cfg.Resources, "resources", cfg.Resources, "resources per request")
+	fs.IntVar(&cfg.ScopesPerResource, "scopes", cfg.ScopesPerResource, "scopes per resource")
+	fs.IntVar(&cfg.ResourceAttributes, "resource-attributes", cfg.ResourceAttributes, "attributes per resource, besides service.name")
+	fs.IntVar(&cfg.Gauges, "gauges", cfg.Gauges, "gauges per scope")
+	fs.IntVar(&cfg.Sums, "sums", cfg.Sums, "sums per scope")
+	fs.IntVar(&cfg.Histograms, "histograms", cfg.Histograms, "histograms per scope")
+	fs.IntVar(&cfg.ExponentialHistograms, "exponential-histograms", cfg.ExponentialHistograms, "exponential histograms per scope")
+	fs.IntVar(&cfg.Summaries, "summaries", cfg.Summaries, "summaries per scope")
+	fs.IntVar(&cfg.SeriesPerMetric, "series", cfg.SeriesPerMetric, "series per metric")
+	fs.IntVar(&cfg.Attributes, "attributes", cfg.Attributes, "attributes per series")
+	fs.IntVar(&cfg.AttributeCardinality, "cardinality", cfg.AttributeCardinality, "distinct values of each attribute but the series one")
+	fs.IntVar(&cfg.LabelValueLength, "value-length", cfg.LabelValueLength, "minimum length of attribute values")
+	fs.IntVar(&cfg.DataPointsPerSeries, "points", cfg.DataPointsPerSeries, "data points per series per request")
+	fs.DurationVar(&cfg.Interval, "interval", cfg.Interval, "interval between data points")
+	fs.Float64Var(&cfg.ChurnRate, "churn", cfg.ChurnRate, "fraction of the series replaced from one request to the next")
+	fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "seed of the generated values")
+	fs.Usage = func() {
+		fmt.Fprintln(stdio.err, "usage: rw2tool generate [flags]\n\nflags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch *temporality {
+	case "cumulative":
+		cfg.Temporality = pmetric.AggregationTemporalityCumulative
+	case "delta":
+		cfg.Temporality = pmetric.AggregationTemporalityDelta
+	default:
+		return fmt.Errorf("unknown temporality %q", *temporality)
+	}
+	switch {
+	case *outFormat != "json" && *outFormat != "proto":
+		return fmt.Errorf("unknown output format %q", *outFormat)
+	case *outFormat == "proto" && *outDir == "" && *batches > 1:
+		return fmt.Errorf("%d protobuf requests can't be told apart on standard output, write them to a directory with -out", *batches)
+	}
+
+	gen, err := otlpgen.New(cfg)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(stdio.out)
+	defer w.Flush()
+	for i := 0; i < *batches; i++ {
+		req := pmetricotlp.NewExportRequestFromMetrics(gen.Next())
+		var payload []byte
+		if *outFormat == "json" {
+			payload, err = req.MarshalJSON()
+			payload = append(payload, '\n')
+		} else {
+			payload, err = req.MarshalProto()
+		}
+		if err != nil {
+			return fmt.Errorf("request %d: %w", i, err)
+		}
+		if *outDir == "" {
+			if _, err := w.Write(payload); err != nil {
+				return err
+			}
+			continue
+		}
+		name := filepath.Join(*outDir, fmt.Sprintf("otlp-%d%s", i, payloadExtensions[*outFormat]))
+		if err := os.WriteFile(name, payload, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	prw "prometheusrwexporter-demo"
+)
+
+func TestGenerateThenConvert(t *testing.T) {
+	var generated, stderr bytes.Buffer
+	// The exporter only converts exponential histograms so far.
+	args := []string{"-batches", "3", "-resources", "2", "-series", "4", "-churn", "0.5", "-gauges", "0", "-sums", "0", "-histograms", "0", "-summaries", "0"}
+	err := runGenerate(args, stdio{out: &generated, err: &stderr})
+	require.NoError(t, err)
+	assert.Equal(t, 3, bytes.Count(generated.Bytes(), []byte("\n")))
+
+	out := t.TempDir()
+	require.NoError(t, runConvert([]string{"-out", out}, stdio{in: &generated, out: &bytes.Buffer{}, err: &stderr}))
+	assert.Empty(t, stderr.String())
+	for _, name := range []string{"stdin-0.snappy", "stdin-1.snappy", "stdin-2.snappy"} {
+		payload, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err)
+		reader, err := prw.DecodeRequest(payload)
+		require.NoError(t, err)
+		// Every resource has the 4 series of its metric.
+		assert.Equal(t, 8, reader.Len())
+	}
+}
+
+func TestGenerateProtoFiles(t *testing.T) {
+	out := t.TempDir()
+	require.NoError(t, runGenerate([]string{"-format", "proto", "-batches", "2", "-out", out}, stdio{out: &bytes.Buffer{}, err: &bytes.Buffer{}}))
+	for _, name := range []string{"otlp-0.pb", "otlp-1.pb"} {
+		assert.FileExists(t, filepath.Join(out, name))
+	}
+}
+
+func TestGenerateRejectsBadFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-temporality", "sideways"},
+		{"-format", "yaml"},
+		{"-format", "proto", "-batches", "2"},
+		{"-churn", "2"},
+	} {
+		err := runGenerate(args, stdio{out: &bytes.Buffer{}, err: &bytes.Buffer{}})
+		assert.Error(t, err, args)
+	}
+}
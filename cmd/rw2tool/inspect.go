@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	prw "prometheusrwexporter-demo"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// runInspect prints the series of captured remote write 2.0 payloads, references resolved,
+// followed by statistics on the payload.
+func runInspect(args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	encoding := fs.String("encoding", "auto", "payload encoding: snappy, raw (protobuf) or auto")
+	statsOnly := fs.Bool("stats", false, "only print the statistics")
+	fs.Usage = func() {
+		fmt.Fprintln(stdio.err, "usage: rw2tool inspect [flags] [files]\n\nReads standard input when no file is given.\n\nflags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	w := bufio.NewWriter(stdio.out)
+	defer w.Flush()
+	for _, file := range files {
+		payload, err := readPayload(file, stdio.in)
+		if err != nil {
+			return err
+		}
+		reader, err := decodePayload(payload, *encoding)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if len(files) > 1 {
+			fmt.Fprintf(w, "==> %s <==\n", file)
+		}
+		if !*statsOnly {
+			if err := printSeries(w, reader); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+		}
+		if err := printStats(w, reader); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func readPayload(file string, stdin io.Reader) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(file)
+}
+
+// decodePayload decodes a request from a payload, guessing the encoding if asked to: a
+// valid snappy block is very unlikely to be a valid protobuf message, and the reverse.
+func decodePayload(payload []byte, encoding string) (*prw.RequestReader, error) {
+	switch encoding {
+	case "snappy":
+		return prw.DecodeRequest(payload)
+	case "raw":
+		var req typesv2.Request
+		if err := req.Unmarshal(payload); err != nil {
+			return nil, fmt.Errorf("%w: %v", prw.ErrInvalidRequest, err)
+		}
+		return prw.NewRequestReader(&req)
+	case "auto":
+		if _, err := snappy.DecodedLen(payload); err == nil {
+			if reader, err := prw.DecodeRequest(payload); err == nil {
+				return reader, nil
+			}
+		}
+		return decodePayload(payload, "raw")
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+func printSeries(w io.Writer, reader *prw.RequestReader) error {
+	for i, it := 0, reader.Iterator(); it.Next(); i++ {
+		series := it.At()
+		fmt.Fprintf(w, "series %d %s\n", i, series.Labels)
+		md := series.Metadata
+		fmt.Fprintf(w, "  type: %s", metricTypeName(md.Type))
+		if md.Help != "" {
+			fmt.Fprintf(w, "  help: %q", md.Help)
+		}
+		if md.Unit != "" {
+			fmt.Fprintf(w, "  unit: %q", md.Unit)
+		}
+		fmt.Fprintln(w)
+		if series.CreatedTimestamp != 0 {
+			fmt.Fprintf(w, "  created: %s\n", formatTimestamp(series.CreatedTimestamp))
+		}
+		for _, s := range series.Samples {
+			fmt.Fprintf(w, "  sample %s %g\n", formatTimestamp(s.Timestamp), s.Value)
+		}
+		for _, h := range series.Histograms {
+			if err := printHistogram(w, h); err != nil {
+				return fmt.Errorf("series %d: %w", i, err)
+			}
+		}
+		for _, e := range series.Exemplars {
+			fmt.Fprintf(w, "  exemplar %s %g %s\n", formatTimestamp(e.Timestamp), e.Value, e.Labels)
+		}
+	}
+	return nil
+}
+
+func printHistogram(w io.Writer, h typesv2.Histogram) error {
+	count, _ := prw.HistogramCounts(h)
+	schema := fmt.Sprint(h.Schema)
+	if len(h.CustomValues) > 0 {
+		schema += " (custom buckets)"
+	}
+	fmt.Fprintf(w, "  histogram %s count=%g sum=%g schema=%s", formatTimestamp(h.Timestamp), count, h.Sum, schema)
+	if h.ResetHint != typesv2.Histogram_RESET_HINT_UNSPECIFIED {
+		fmt.Fprintf(w, " reset_hint=%s", strings.ToLower(strings.TrimPrefix(h.ResetHint.String(), "RESET_HINT_")))
+	}
+	fmt.Fprintln(w)
+
+	buckets, err := prw.HistogramBuckets(h)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		fmt.Fprintf(w, "    %-28s %g\n", b, b.Count)
+	}
+	return nil
+}
+
+func printStats(w io.Writer, reader *prw.RequestReader) error {
+	req := reader.Request()
+	symbolBytes := 0
+	for _, s := range req.Symbols {
+		symbolBytes += len(s)
+	}
+	stats := prw.RequestStats(reader)
+
+	v2, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	v1, err := equivalentV1Request(reader).Marshal()
+	if err != nil {
+		return err
+	}
+	v2Snappy, v1Snappy := len(snappy.Encode(nil, v2)), len(snappy.Encode(nil, v1))
+	// Compact a copy, the request is the one being inspected.
+	var compacted typesv2.Request
+	if err := compacted.Unmarshal(v2); err != nil {
+		return err
+	}
+	compaction, err := prw.CompactSymbols(&compacted)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "stats")
+	fmt.Fprintf(w, "  series:       %d\n", reader.Len())
+	fmt.Fprintf(w, "  samples:      %d\n", stats.Samples)
+	fmt.Fprintf(w, "  histograms:   %d\n", stats.Histograms)
+	fmt.Fprintf(w, "  exemplars:    %d\n", stats.Exemplars)
+	fmt.Fprintf(w, "  symbols:      %d (%d bytes)\n", len(req.Symbols), symbolBytes)
+	fmt.Fprintf(w, "  size:         %d bytes, %d snappy compressed\n", len(v2), v2Snappy)
+	fmt.Fprintf(w, "  size as v1:   %d bytes, %d snappy compressed\n", len(v1), v1Snappy)
+	fmt.Fprintf(w, "  saved vs v1:  %s, %s snappy compressed\n", savings(len(v1), len(v2)), savings(v1Snappy, v2Snappy))
+	fmt.Fprintf(w, "  compaction:   %s, %d unused symbols\n", savings(compaction.SizeBefore, compaction.SizeAfter), compaction.Dropped)
+	return nil
+}
+
+func savings(v1, v2 int) string {
+	if v1 == 0 {
+		return "0 bytes"
+	}
+	return fmt.Sprintf("%d bytes (%.1f%%)", v1-v2, 100*float64(v1-v2)/float64(v1))
+}
+
+// equivalentV1Request is what a remote write 1.0 sender would send for the same series:
+// labels repeated in every series, and metadata once per metric family.
+func equivalentV1Request(reader *prw.RequestReader) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	families := map[string]bool{}
+	for it := reader.Iterator(); it.Next(); {
+		series := it.At()
+		ts := prompb.TimeSeries{Labels: v1Labels(series.Labels)}
+		for _, s := range series.Samples {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: s.Value, Timestamp: s.Timestamp})
+		}
+		for _, h := range series.Histograms {
+			ts.Histograms = append(ts.Histograms, prw.V2ToV1Histogram(h))
+		}
+		for _, e := range series.Exemplars {
+			ts.Exemplars = append(ts.Exemplars, prompb.Exemplar{Labels: v1Labels(e.Labels), Value: e.Value, Timestamp: e.Timestamp})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+
+		name := series.Labels.Get(labels.MetricName)
+		if md := series.Metadata; md.Type != typesv2.Metadata_METRIC_TYPE_UNSPECIFIED && !families[name] {
+			families[name] = true
+			req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+				Type:             prompb.MetricMetadata_MetricType(md.Type),
+				MetricFamilyName: name,
+				Help:             md.Help,
+				Unit:             md.Unit,
+			})
+		}
+	}
+	return req
+}
+
+func v1Labels(lbls labels.Labels) []prompb.Label {
+	out := make([]prompb.Label, 0, lbls.Len())
+	lbls.Range(func(l labels.Label) {
+		out = append(out, prompb.Label{Name: l.Name, Value: l.Value})
+	})
+	return out
+}
+
+func metricTypeName(t typesv2.Metadata_MetricType) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "METRIC_TYPE_"))
+}
+
+func formatTimestamp(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+}
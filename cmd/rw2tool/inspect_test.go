@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// testRequest is a request with a counter and a histogram, its symbols resolved by hand.
+func testRequest() *typesv2.Request {
+	return &typesv2.Request{
+		Symbols: []string{"", "__name__", "http_requests_total", "job", "api", "Requests.", "latency_seconds", "seconds", "trace_id", "abc"},
+		Timeseries: []typesv2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Metadata:   typesv2.Metadata{Type: typesv2.Metadata_METRIC_TYPE_COUNTER, HelpRef: 5},
+				Samples:    []typesv2.Sample{{Value: 42, Timestamp: 1000}},
+				Exemplars:  []typesv2.Exemplar{{LabelsRefs: []uint32{8, 9}, Value: 1, Timestamp: 900}},
+			},
+			{
+				LabelsRefs: []uint32{1, 6, 3, 4},
+				Metadata:   typesv2.Metadata{Type: typesv2.Metadata_METRIC_TYPE_HISTOGRAM, UnitRef: 7},
+				Histograms: []typesv2.Histogram{{
+					Count:          &typesv2.Histogram_CountInt{CountInt: 3},
+					Sum:            2.5,
+					PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 2}},
+					PositiveDeltas: []int64{1, 1},
+					Timestamp:      1000,
+				}},
+			},
+		},
+	}
+}
+
+func TestInspect(t *testing.T) {
+	pBuf, err := testRequest().Marshal()
+	require.NoError(t, err)
+
+	for name, payload := range map[string][]byte{"snappy": snappy.Encode(nil, pBuf), "raw": pBuf} {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			require.NoError(t, runInspect(nil, stdio{in: bytes.NewReader(payload), out: &stdout, err: &stderr}))
+
+			out := stdout.String()
+			assert.Contains(t, out, "series 0 {__name__=\"http_requests_total\", job=\"api\"}\n  type: counter  help: \"Requests.\"\n")
+			assert.Contains(t, out, "  sample 1970-01-01T00:00:01Z 42\n")
+			assert.Contains(t, out, "  exemplar 1970-01-01T00:00:00.9Z 1 {trace_id=\"abc\"}\n")
+			assert.Contains(t, out, "  type: histogram  unit: \"seconds\"\n")
+			assert.Contains(t, out, "  histogram 1970-01-01T00:00:01Z count=3 sum=2.5 schema=0\n")
+			assert.Contains(t, out, "    (0.5, 1]                     1\n    (1, 2]                       2\n")
+			assert.Contains(t, out, "  symbols:      10 (75 bytes)\n")
+			assert.Contains(t, out, "  saved vs v1:  ")
+			assert.Contains(t, out, "  compaction:   0 bytes (0.0%), 0 unused symbols\n")
+		})
+	}
+}
+
+func TestInspectStatsOnly(t *testing.T) {
+	pBuf, err := testRequest().Marshal()
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, runInspect([]string{"-stats", "-encoding", "raw"}, stdio{in: bytes.NewReader(pBuf), out: &stdout, err: &stderr}))
+	assert.NotContains(t, stdout.String(), "series 0")
+	assert.Contains(t, stdout.String(), "  series:       2\n")
+
+	err = runInspect([]string{"-encoding", "snappy"}, stdio{in: bytes.NewReader(pBuf), out: &stdout, err: &stderr})
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+// Command rw2tool helps debugging Prometheus Remote Write 2.0 conversions offline.
+//
+// Usage:
+//
+//	rw2tool <command> [flags] [files]
+//
+// The commands are:
+//
+//	convert    convert OTLP export requests into remote write 2.0 payloads
+//	inspect    print remote write 2.0 payloads in a human readable form
+//	diff       compare two remote write 2.0 payloads semantically
+//	generate   generate synthetic OTLP export requests
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+type stdio struct {
+	in       io.Reader
+	out, err io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(args []string, stdio stdio) error
+}
+
+var commands = map[string]command{
+	"convert":  {"convert OTLP export requests into remote write 2.0 payloads", runConvert},
+	"inspect":  {"print remote write 2.0 payloads in a human readable form", runInspect},
+	"diff":     {"compare two remote write 2.0 payloads semantically", runDiff},
+	"generate": {"generate synthetic OTLP export requests", runGenerate},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rw2tool: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(os.Args[2:], stdio{in: os.Stdin, out: os.Stdout, err: os.Stderr})
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rw2tool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rw2tool <command> [flags] [files]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
@@ -0,0 +1,77 @@
+package prometheusremotewritev2
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+)
+
+// Config defines the configuration of the Prometheus Remote Write 2.0 exporter.
+type Config struct {
+	// Endpoint is the URL the requests are posted to.
+	Endpoint string            `mapstructure:"endpoint"`
+	Timeout  time.Duration     `mapstructure:"timeout"`
+	Headers  map[string]string `mapstructure:"headers"`
+
+	Retry  RetryConfig   `mapstructure:"retry_on_failure"`
+	Limits RequestLimits `mapstructure:"limits"`
+	Queue  QueueConfig   `mapstructure:"remote_write_queue"`
+
+	// ConversionWorkers is the number of goroutines converting the resources of a batch,
+	// GOMAXPROCS if zero. Batches of few resources are converted on a single goroutine.
+	ConversionWorkers int `mapstructure:"conversion_workers"`
+	// SeriesOrder is the order of the series in every request sent, input by default. With
+	// labels, each shard sorts the series of a request by label set.
+	SeriesOrder SeriesOrder `mapstructure:"series_order"`
+	// CompactSymbols orders the symbols table of every request by number of references,
+	// which makes the references smaller.
+	CompactSymbols bool `mapstructure:"compact_symbols"`
+}
+
+var _ component.Config = (*Config)(nil)
+
+func (cfg *Config) Validate() error {
+	if cfg.Endpoint == "" {
+		return errors.New("endpoint must not be empty")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid endpoint %q: scheme must be http or https", cfg.Endpoint)
+	}
+	if cfg.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if cfg.ConversionWorkers < 0 {
+		return errors.New("conversion_workers must not be negative")
+	}
+	if err := cfg.SeriesOrder.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Limits.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Retry.Validate(); err != nil {
+		return err
+	}
+	return cfg.Queue.Validate()
+}
+
+func (cfg *Config) clientConfig() httpClientConfig {
+	return httpClientConfig{
+		Endpoint: cfg.Endpoint,
+		Timeout:  cfg.Timeout,
+		Headers:  cfg.Headers,
+		Retry:    cfg.Retry,
+		Limits:   cfg.Limits,
+
+		ConversionWorkers: cfg.ConversionWorkers,
+		SeriesOrder:       cfg.SeriesOrder,
+		CompactSymbols:    cfg.CompactSymbols,
+	}
+}
@@ -0,0 +1,74 @@
+package prometheusremotewritev2
+
+import (
+	"runtime"
+	"sync"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/multierr"
+)
+
+// minResourcesPerWorker keeps batches of few resources on a single goroutine, where
+// spawning workers would cost more than it saves.
+const minResourcesPerWorker = 8
+
+// conversionWorkers is the number of goroutines to convert the batch with.
+func (builder *V2WriteRequestBuilder) conversionWorkers() int {
+	workers := builder.httpClientConfig.ConversionWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return min(workers, len(builder.resources)/minResourcesPerWorker)
+}
+
+// convertParallel converts the resources on n goroutines, each converting a contiguous run
+// of them with a builder of its own, and symbols table if symbolize is set. The symbols
+// tables are then merged in order into the one of the builder and the label references
+// remapped, so that the result is the very same as a conversion on a single goroutine.
+func (builder *V2WriteRequestBuilder) convertParallel(n int, symbolize bool) error {
+	for len(builder.workers) < n {
+		worker := &V2WriteRequestBuilder{
+			scopeMetricSlices: make(map[resourceID][]pmetric.Metric),
+			symbols:           NewSymbolsTable(),
+			httpClientConfig:  builder.httpClientConfig,
+		}
+		// Workers convert on their own goroutine.
+		worker.httpClientConfig.ConversionWorkers = 1
+		builder.workers = append(builder.workers, worker)
+	}
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for w, worker := range builder.workers[:n] {
+		worker.Reset()
+		first, last := w*len(builder.resources)/n, (w+1)*len(builder.resources)/n
+		for id := first; id < last; id++ {
+			worker.addResource(builder.resources[id], builder.scopeMetricSlices[resourceID(id)]...)
+		}
+		wg.Add(1)
+		go func(w int, worker *V2WriteRequestBuilder) {
+			defer wg.Done()
+			errs[w] = worker.convertAll(symbolize)
+		}(w, worker)
+	}
+	wg.Wait()
+
+	if symbolize {
+		builder.symbols.Reset()
+	}
+	for _, worker := range builder.workers[:n] {
+		if symbolize {
+			builder.remap = builder.remap[:0]
+			for _, symbol := range worker.symbols.symbols {
+				builder.remap = append(builder.remap, builder.symbols.Symbolize(symbol))
+			}
+			for _, ts := range worker.tsSlice {
+				for i, ref := range ts.labelRef {
+					ts.labelRef[i] = builder.remap[ref]
+				}
+			}
+		}
+		builder.tsSlice = append(builder.tsSlice, worker.tsSlice...)
+	}
+	return multierr.Combine(errs...)
+}
@@ -0,0 +1,86 @@
+package prometheusremotewritev2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+// buildWithWorkers builds md anew with builder and returns the encoded request and the
+// conversion error.
+func buildWithWorkers(t *testing.T, builder *V2WriteRequestBuilder, md pmetric.Metrics) ([]byte, error) {
+	builder.Reset()
+	builder.Add(md)
+	req, err := builder.Build()
+	pBuf, merr := req.Marshal()
+	require.NoError(t, merr)
+	return pBuf, err
+}
+
+func newBuilderWithWorkers(t *testing.T, workers int) *V2WriteRequestBuilder {
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{ConversionWorkers: workers})
+	require.NoError(t, err)
+	return builder
+}
+
+func TestParallelBuildMatchesSerialBuild(t *testing.T) {
+	md := generateWorkload(t, 2)
+	// Some metrics can't be converted, their errors must come out in the same order.
+	for i := 0; i < md.ResourceMetrics().Len(); i += 7 {
+		gauge := md.ResourceMetrics().At(i).ScopeMetrics().At(0).Metrics().AppendEmpty()
+		gauge.SetName("unsupported")
+		gauge.SetEmptyGauge().DataPoints().AppendEmpty()
+	}
+
+	serial, serialErr := buildWithWorkers(t, newBuilderWithWorkers(t, 1), md)
+	require.Error(t, serialErr)
+
+	parallel := newBuilderWithWorkers(t, 4)
+	for i := 0; i < 3; i++ {
+		pBuf, err := buildWithWorkers(t, parallel, md)
+		require.Equal(t, 4, parallel.conversionWorkers())
+		assert.Equal(t, serial, pBuf, "build %d", i)
+		assert.Equal(t, serialErr.Error(), err.Error())
+	}
+
+	// Workers are reused, and so are their series by serial builds in between.
+	_, err := buildWithWorkers(t, parallel, generateWorkload(t, 0))
+	require.NoError(t, err)
+	pBuf, err := buildWithWorkers(t, parallel, md)
+	assert.Equal(t, serial, pBuf)
+	assert.Equal(t, serialErr.Error(), err.Error())
+}
+
+func TestParallelConversionKeepsInputOrder(t *testing.T) {
+	md := generateWorkload(t, 2)
+	serial := newBuilderWithWorkers(t, 1)
+	serial.Add(md)
+	require.NoError(t, serial.makeTimeSeriesSlice())
+	parallel := newBuilderWithWorkers(t, 3)
+	parallel.Add(md)
+	require.NoError(t, parallel.makeTimeSeriesSlice())
+
+	require.Len(t, parallel.tsSlice, len(serial.tsSlice))
+	for i := range serial.tsSlice {
+		assert.Equal(t, serial.tsSlice[i].labelSet, parallel.tsSlice[i].labelSet)
+	}
+}
+
+func TestConversionWorkers(t *testing.T) {
+	builder := newBuilderWithWorkers(t, 16)
+	builder.Add(generateWorkload(t, 0))
+	assert.Equal(t, 0, builder.conversionWorkers(), "a single resource is converted serially")
+
+	builder.Reset()
+	builder.Add(generateWorkload(t, 2))
+	assert.Equal(t, 12, builder.conversionWorkers(), "every worker converts a few resources at least")
+
+	builder = newBuilderWithWorkers(t, 2)
+	builder.Add(generateWorkload(t, 2))
+	assert.Equal(t, 2, builder.conversionWorkers())
+
+	_, err := NewV2WriteRequestBuilder(httpClientConfig{ConversionWorkers: -1})
+	assert.Error(t, err)
+}
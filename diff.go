@@ -0,0 +1,209 @@
+package prometheusremotewritev2
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// DiffKind tells what differs between two requests.
+type DiffKind string
+
+const (
+	DiffSeriesAdded      DiffKind = "series_added"
+	DiffSeriesRemoved    DiffKind = "series_removed"
+	DiffMetadata         DiffKind = "metadata"
+	DiffCreatedTimestamp DiffKind = "created_timestamp"
+	DiffSample           DiffKind = "sample"
+	DiffHistogram        DiffKind = "histogram"
+	DiffExemplar         DiffKind = "exemplar"
+)
+
+// Difference is a difference between a series of two requests. Old and New render what
+// differs, and are empty where it is missing, like the new value of a removed sample.
+type Difference struct {
+	Kind   DiffKind
+	Series labels.Labels
+	// Timestamp is the timestamp of the sample, histogram or exemplar that differs.
+	Timestamp int64
+	Old, New  string
+}
+
+func (d Difference) String() string {
+	switch d.Kind {
+	case DiffSeriesAdded:
+		return fmt.Sprintf("+ %s", d.Series)
+	case DiffSeriesRemoved:
+		return fmt.Sprintf("- %s", d.Series)
+	case DiffMetadata, DiffCreatedTimestamp:
+		return fmt.Sprintf("~ %s %s: %s -> %s", d.Series, d.Kind, orNone(d.Old), orNone(d.New))
+	}
+	return fmt.Sprintf("~ %s %s@%d: %s -> %s", d.Series, d.Kind, d.Timestamp, orNone(d.Old), orNone(d.New))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// DiffRequests compares two requests semantically: series are matched by their label sets,
+// whatever the order of the series, of the symbols and the values of the references; samples,
+// histograms and exemplars by timestamp. Histograms are compared by count, sum and buckets,
+// not by how the buckets are encoded. The differences are sorted by series, then kind and
+// timestamp.
+func DiffRequests(oldReq, newReq *typesv2.Request) ([]Difference, error) {
+	oldReader, err := NewRequestReader(oldReq)
+	if err != nil {
+		return nil, fmt.Errorf("old request: %w", err)
+	}
+	newReader, err := NewRequestReader(newReq)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	oldSeries, err := indexSeries(oldReader)
+	if err != nil {
+		return nil, fmt.Errorf("old request: %w", err)
+	}
+	newSeries, err := indexSeries(newReader)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	var diffs []Difference
+	for key, o := range oldSeries {
+		n, ok := newSeries[key]
+		if !ok {
+			diffs = append(diffs, Difference{Kind: DiffSeriesRemoved, Series: o.labels})
+			continue
+		}
+		diffs = append(diffs, o.diff(n)...)
+	}
+	for key, n := range newSeries {
+		if _, ok := oldSeries[key]; !ok {
+			diffs = append(diffs, Difference{Kind: DiffSeriesAdded, Series: n.labels})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if c := labels.Compare(diffs[i].Series, diffs[j].Series); c != 0 {
+			return c < 0
+		}
+		if diffs[i].Kind != diffs[j].Kind {
+			return diffs[i].Kind < diffs[j].Kind
+		}
+		return diffs[i].Timestamp < diffs[j].Timestamp
+	})
+	return diffs, nil
+}
+
+// comparableSeries is a series with every value rendered, keyed by timestamp. Series
+// repeated in a request are merged.
+type comparableSeries struct {
+	labels           labels.Labels
+	metadata         string
+	createdTimestamp string
+	samples          map[int64]string
+	histograms       map[int64]string
+	exemplars        map[int64]string
+}
+
+func indexSeries(reader *RequestReader) (map[string]*comparableSeries, error) {
+	index := make(map[string]*comparableSeries, reader.Len())
+	for it := reader.Iterator(); it.Next(); {
+		series := it.At()
+		key := series.Labels.String()
+		cs, ok := index[key]
+		if !ok {
+			cs = &comparableSeries{
+				labels:     series.Labels,
+				samples:    map[int64]string{},
+				histograms: map[int64]string{},
+				exemplars:  map[int64]string{},
+			}
+			index[key] = cs
+		}
+		md := series.Metadata
+		cs.metadata = fmt.Sprintf("type=%s help=%q unit=%q", strings.ToLower(strings.TrimPrefix(md.Type.String(), "METRIC_TYPE_")), md.Help, md.Unit)
+		if series.CreatedTimestamp != 0 {
+			cs.createdTimestamp = fmt.Sprint(series.CreatedTimestamp)
+		}
+		for _, s := range series.Samples {
+			cs.samples[s.Timestamp] = formatFloat(s.Value)
+		}
+		for _, h := range series.Histograms {
+			rendered, err := formatHistogram(h)
+			if err != nil {
+				return nil, fmt.Errorf("series %s: %w", series.Labels, err)
+			}
+			cs.histograms[h.Timestamp] = rendered
+		}
+		for _, e := range series.Exemplars {
+			exemplar := fmt.Sprintf("%s %s", formatFloat(e.Value), e.Labels)
+			if prev := cs.exemplars[e.Timestamp]; prev != "" {
+				exemplar = prev + ", " + exemplar
+			}
+			cs.exemplars[e.Timestamp] = exemplar
+		}
+	}
+	return index, nil
+}
+
+func (o *comparableSeries) diff(n *comparableSeries) []Difference {
+	var diffs []Difference
+	if o.metadata != n.metadata {
+		diffs = append(diffs, Difference{Kind: DiffMetadata, Series: o.labels, Old: o.metadata, New: n.metadata})
+	}
+	if o.createdTimestamp != n.createdTimestamp {
+		diffs = append(diffs, Difference{Kind: DiffCreatedTimestamp, Series: o.labels, Old: o.createdTimestamp, New: n.createdTimestamp})
+	}
+	for _, values := range []struct {
+		kind     DiffKind
+		old, new map[int64]string
+	}{
+		{DiffSample, o.samples, n.samples},
+		{DiffHistogram, o.histograms, n.histograms},
+		{DiffExemplar, o.exemplars, n.exemplars},
+	} {
+		for ts, oldValue := range values.old {
+			if newValue := values.new[ts]; newValue != oldValue {
+				diffs = append(diffs, Difference{Kind: values.kind, Series: o.labels, Timestamp: ts, Old: oldValue, New: newValue})
+			}
+		}
+		for ts, newValue := range values.new {
+			if _, ok := values.old[ts]; !ok {
+				diffs = append(diffs, Difference{Kind: values.kind, Series: o.labels, Timestamp: ts, New: newValue})
+			}
+		}
+	}
+	return diffs
+}
+
+// formatFloat renders a float so that it compares equal only to the very same value,
+// stale markers and other NaNs included.
+func formatFloat(f float64) string {
+	if math.IsNaN(f) {
+		return fmt.Sprintf("NaN(%#x)", math.Float64bits(f))
+	}
+	return fmt.Sprint(f)
+}
+
+func formatHistogram(h typesv2.Histogram) (string, error) {
+	buckets, err := HistogramBuckets(h)
+	if err != nil {
+		return "", err
+	}
+	count, _ := HistogramCounts(h)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "count=%s sum=%s", formatFloat(count), formatFloat(h.Sum))
+	for _, b := range buckets {
+		fmt.Fprintf(&sb, " %s:%s", b, formatFloat(b.Count))
+	}
+	return sb.String(), nil
+}
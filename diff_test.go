@@ -0,0 +1,103 @@
+package prometheusremotewritev2
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+type testSeries struct {
+	labels []prompb.Label
+	ts     typesv2.TimeSeries
+}
+
+// requestOf builds a request of the given series, interning symbols in the order they come.
+func requestOf(series ...testSeries) *typesv2.Request {
+	symbols := NewSymbolsTable()
+	req := &typesv2.Request{}
+	for _, s := range series {
+		ts := s.ts
+		ts.LabelsRefs = symbolizeLabelRefs(&symbols, s.labels)
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	req.Symbols = symbols.symbols
+	return req
+}
+
+func TestDiffRequestsIgnoresSymbolOrder(t *testing.T) {
+	up := testSeries{
+		labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		ts:     typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1, Timestamp: 1}}},
+	}
+	latency := testSeries{
+		labels: []prompb.Label{{Name: "job", Value: "b"}, {Name: "__name__", Value: "latency"}},
+		ts: typesv2.TimeSeries{Histograms: []typesv2.Histogram{{
+			Count:          &typesv2.Histogram_CountInt{CountInt: 2},
+			PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 2}},
+			PositiveDeltas: []int64{1, 0},
+			Timestamp:      1,
+		}}},
+	}
+	// The same histogram, with its buckets encoded as two spans of float counts.
+	latencyFloat := latency
+	latencyFloat.ts = typesv2.TimeSeries{Histograms: []typesv2.Histogram{{
+		Count:          &typesv2.Histogram_CountFloat{CountFloat: 2},
+		PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 1}, {Offset: 0, Length: 1}},
+		PositiveCounts: []float64{1, 1},
+		Timestamp:      1,
+	}}}
+
+	diffs, err := DiffRequests(requestOf(up, latency), requestOf(latencyFloat, up))
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+}
+
+func TestDiffRequestsReportsDifferences(t *testing.T) {
+	series := func(name string, samples ...typesv2.Sample) testSeries {
+		return testSeries{
+			labels: []prompb.Label{{Name: "__name__", Value: name}},
+			ts:     typesv2.TimeSeries{Samples: samples},
+		}
+	}
+	kept := series("kept", typesv2.Sample{Value: 1, Timestamp: 1}, typesv2.Sample{Value: 2, Timestamp: 2})
+	changed := series("kept", typesv2.Sample{Value: 1, Timestamp: 1}, typesv2.Sample{Value: 3, Timestamp: 2}, typesv2.Sample{Value: 4, Timestamp: 3})
+	changed.ts.Metadata.Type = typesv2.Metadata_METRIC_TYPE_GAUGE
+	histogram := func(count int64) testSeries {
+		return testSeries{
+			labels: []prompb.Label{{Name: "__name__", Value: "latency"}},
+			ts: typesv2.TimeSeries{Histograms: []typesv2.Histogram{{
+				PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 1}},
+				PositiveDeltas: []int64{count},
+				Timestamp:      1,
+			}}},
+		}
+	}
+
+	diffs, err := DiffRequests(
+		requestOf(kept, series("removed"), histogram(1)),
+		requestOf(changed, series("added"), histogram(2)),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []Difference{
+		{Kind: DiffSeriesAdded, Series: labels.FromStrings("__name__", "added")},
+		{Kind: DiffMetadata, Series: labels.FromStrings("__name__", "kept"), Old: `type=unspecified help="" unit=""`, New: `type=gauge help="" unit=""`},
+		{Kind: DiffSample, Series: labels.FromStrings("__name__", "kept"), Timestamp: 2, Old: "2", New: "3"},
+		{Kind: DiffSample, Series: labels.FromStrings("__name__", "kept"), Timestamp: 3, New: "4"},
+		{Kind: DiffHistogram, Series: labels.FromStrings("__name__", "latency"), Timestamp: 1, Old: "count=0 sum=0 (0.5, 1]:1", New: "count=0 sum=0 (0.5, 1]:2"},
+		{Kind: DiffSeriesRemoved, Series: labels.FromStrings("__name__", "removed")},
+	}, diffs)
+	assert.Equal(t, `~ {__name__="kept"} sample@3: none -> 4`, diffs[3].String())
+}
+
+func TestDiffRequestsRejectsInvalidRequests(t *testing.T) {
+	valid := requestWithSeries(1, 1)
+	invalid := requestWithSeries(1, 1)
+	invalid.Timeseries[0].LabelsRefs[0] = 100
+
+	_, err := DiffRequests(&valid, &invalid)
+	assert.ErrorIs(t, err, ErrInvalidRequest)
+}
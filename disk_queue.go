@@ -0,0 +1,491 @@
+package prometheusremotewritev2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Every record is framed as <payload length uint32><crc32c of the payload uint32><payload>.
+	recordHeaderSize = 8
+	checkpointFile   = "checkpoint"
+	segmentNameLen   = 8
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errQueueEmpty  = errors.New("disk queue is empty")
+	errCorruptData = errors.New("corrupt record")
+)
+
+// FsyncPolicy tells when the disk queue forces its writes to stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever FsyncPolicy = iota
+	// FsyncSegment syncs whenever a segment is completed and on Close.
+	FsyncSegment
+	// FsyncAlways syncs after every appended record.
+	FsyncAlways
+)
+
+var fsyncPolicyNames = []string{"never", "segment", "always"}
+
+func (p FsyncPolicy) String() string {
+	if p < 0 || int(p) >= len(fsyncPolicyNames) {
+		return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+	}
+	return fsyncPolicyNames[p]
+}
+
+// UnmarshalText lets the policy be configured by name.
+func (p *FsyncPolicy) UnmarshalText(text []byte) error {
+	for i, name := range fsyncPolicyNames {
+		if string(text) == name {
+			*p = FsyncPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown fsync policy %q, expected one of %v", text, fsyncPolicyNames)
+}
+
+// DiskQueueConfig configures the persistent queue. An empty Directory disables it.
+type DiskQueueConfig struct {
+	Directory string `mapstructure:"directory"`
+	// SegmentSize is the size in bytes after which a new segment file is started.
+	SegmentSize int64 `mapstructure:"segment_size"`
+	// MaxSize caps the bytes kept on disk, whole segments are evicted oldest first beyond it.
+	MaxSize int64       `mapstructure:"max_size"`
+	Fsync   FsyncPolicy `mapstructure:"fsync"`
+}
+
+func DefaultDiskQueueConfig(directory string) DiskQueueConfig {
+	return DiskQueueConfig{
+		Directory:   directory,
+		SegmentSize: 8 << 20,
+		MaxSize:     512 << 20,
+		Fsync:       FsyncSegment,
+	}
+}
+
+func (cfg DiskQueueConfig) Validate() error {
+	if cfg.Directory == "" {
+		return nil
+	}
+	if cfg.SegmentSize <= recordHeaderSize {
+		return errors.New("disk queue: segment size is too small")
+	}
+	if cfg.MaxSize < 2*cfg.SegmentSize {
+		return errors.New("disk queue: max size must hold at least two segments")
+	}
+	return nil
+}
+
+type segment struct {
+	index int
+	size  int64
+}
+
+type position struct {
+	segment int
+	offset  int64
+}
+
+// DiskQueue is a FIFO of encoded requests kept in segment files, so that whatever was not
+// sent yet survives a restart. Records stay on disk until they are acknowledged; the
+// position of the oldest unacknowledged record is kept in a checkpoint file.
+type DiskQueue struct {
+	cfg DiskQueueConfig
+
+	mtx      sync.Mutex
+	segments []*segment
+	head     position
+	headLen  int64
+	tail     *os.File
+	size     int64
+	evicted  int64
+	// evictedRecords counts the records evicted before they were acknowledged.
+	evictedRecords int64
+	notify         chan struct{}
+}
+
+// OpenDiskQueue opens the queue in cfg.Directory, repairing segments that were cut short
+// by a crash and resuming after the last acknowledged record.
+func OpenDiskQueue(cfg DiskQueueConfig) (*DiskQueue, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o750); err != nil {
+		return nil, err
+	}
+
+	q := &DiskQueue{cfg: cfg, notify: make(chan struct{}, 1)}
+	indexes, err := listSegments(cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		size, err := repairSegment(q.segmentPath(index), cfg.SegmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("repairing segment %d: %w", index, err)
+		}
+		q.segments = append(q.segments, &segment{index: index, size: size})
+		q.size += size
+	}
+
+	q.head = q.readCheckpoint()
+	for len(q.segments) > 0 && q.segments[0].index < q.head.segment {
+		if err := q.removeOldestSegment(); err != nil {
+			return nil, err
+		}
+	}
+	if len(q.segments) == 0 || q.head.segment != q.segments[0].index || q.head.offset > q.segments[0].size {
+		// The checkpoint is missing or points at data that did not survive, start over from
+		// what is left: it is better to send a request twice than to lose it.
+		q.head = position{}
+		if len(q.segments) > 0 {
+			q.head.segment = q.segments[0].index
+		}
+	}
+
+	next := q.head.segment
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1].index
+	}
+	if err := q.openTail(next); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Append adds a record at the end of the queue. It returns the number of records that were
+// not acknowledged yet, but had to be evicted to keep the queue within MaxSize.
+func (q *DiskQueue) Append(payload []byte) (int, error) {
+	if len(payload) == 0 {
+		return 0, errors.New("disk queue: empty record")
+	}
+	recLen := int64(recordHeaderSize + len(payload))
+	if recLen > q.cfg.SegmentSize {
+		return 0, fmt.Errorf("disk queue: record of %d bytes does not fit in a segment", len(payload))
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+recLen > q.cfg.SegmentSize {
+		if err := q.rollSegment(); err != nil {
+			return 0, err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	buf := make([]byte, recLen)
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(payload, castagnoliTable))
+	copy(buf[recordHeaderSize:], payload)
+	if _, err := q.tail.Write(buf); err != nil {
+		return 0, err
+	}
+	if q.cfg.Fsync == FsyncAlways {
+		if err := q.tail.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	last.size += recLen
+	q.size += recLen
+
+	evicted := 0
+	for q.size > q.cfg.MaxSize && len(q.segments) > 1 {
+		seg := q.segments[0]
+		if q.head.segment == seg.index {
+			evicted += countRecords(q.segmentPath(seg.index), q.head.offset, seg.size)
+		}
+		q.evicted += seg.size
+		if err := q.removeOldestSegment(); err != nil {
+			q.evictedRecords += int64(evicted)
+			return evicted, err
+		}
+		if q.head.segment < q.segments[0].index {
+			q.head, q.headLen = position{segment: q.segments[0].index}, 0
+		}
+	}
+	q.evictedRecords += int64(evicted)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return evicted, nil
+}
+
+// Peek returns the oldest record that was not acknowledged yet, or errQueueEmpty.
+func (q *DiskQueue) Peek() ([]byte, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for {
+		seg := q.segments[0]
+		if q.head.offset < seg.size {
+			break
+		}
+		if len(q.segments) == 1 {
+			return nil, errQueueEmpty
+		}
+		if err := q.removeOldestSegment(); err != nil {
+			return nil, err
+		}
+		q.head = position{segment: q.segments[0].index}
+	}
+
+	f, err := os.Open(q.segmentPath(q.head.segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	payload, err := readRecord(io.NewSectionReader(f, q.head.offset, q.segments[0].size-q.head.offset), q.cfg.SegmentSize)
+	if err != nil {
+		// Whatever follows a damaged record can't be framed anymore, give up on the rest
+		// of the segment so a single bad record doesn't block the queue.
+		q.head.offset = q.segments[0].size
+		return nil, fmt.Errorf("segment %d: %w", q.head.segment, err)
+	}
+	q.headLen = int64(recordHeaderSize + len(payload))
+	return payload, nil
+}
+
+// Ack drops the record last returned by Peek.
+func (q *DiskQueue) Ack() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.headLen == 0 {
+		return nil
+	}
+	q.head.offset += q.headLen
+	q.headLen = 0
+	return q.writeCheckpoint()
+}
+
+// Notify returns a channel that receives whenever a record is appended.
+func (q *DiskQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Size is the number of bytes the queue keeps on disk, including acknowledged records of
+// segments that were not removed yet.
+func (q *DiskQueue) Size() int64 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.size
+}
+
+// Evicted is the number of bytes dropped because the queue outgrew MaxSize.
+func (q *DiskQueue) Evicted() int64 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.evicted
+}
+
+// EvictedRecords is the number of records dropped before they were acknowledged because
+// the queue outgrew MaxSize.
+func (q *DiskQueue) EvictedRecords() int64 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.evictedRecords
+}
+
+func (q *DiskQueue) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.cfg.Fsync != FsyncNever {
+		if err := q.tail.Sync(); err != nil {
+			return err
+		}
+	}
+	return q.tail.Close()
+}
+
+func (q *DiskQueue) segmentPath(index int) string {
+	return filepath.Join(q.cfg.Directory, fmt.Sprintf("%0*d", segmentNameLen, index))
+}
+
+func (q *DiskQueue) openTail(index int) error {
+	f, err := os.OpenFile(q.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	q.tail = f
+	if len(q.segments) == 0 || q.segments[len(q.segments)-1].index != index {
+		q.segments = append(q.segments, &segment{index: index})
+	}
+	return nil
+}
+
+func (q *DiskQueue) rollSegment() error {
+	if q.cfg.Fsync != FsyncNever {
+		if err := q.tail.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := q.tail.Close(); err != nil {
+		return err
+	}
+	return q.openTail(q.segments[len(q.segments)-1].index + 1)
+}
+
+// removeOldestSegment deletes the first segment, which must not be the one written to.
+func (q *DiskQueue) removeOldestSegment() error {
+	seg := q.segments[0]
+	if err := os.Remove(q.segmentPath(seg.index)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.size -= seg.size
+	q.segments = q.segments[1:]
+	return nil
+}
+
+func (q *DiskQueue) readCheckpoint() position {
+	buf, err := os.ReadFile(filepath.Join(q.cfg.Directory, checkpointFile))
+	if err != nil || len(buf) != 20 || crc32.Checksum(buf[:16], castagnoliTable) != binary.BigEndian.Uint32(buf[16:]) {
+		return position{}
+	}
+	return position{
+		segment: int(binary.BigEndian.Uint64(buf[0:])),
+		offset:  int64(binary.BigEndian.Uint64(buf[8:])),
+	}
+}
+
+// writeCheckpoint replaces the checkpoint atomically so a crash leaves either the old or
+// the new one behind.
+func (q *DiskQueue) writeCheckpoint() error {
+	buf := make([]byte, 20)
+	binary.BigEndian.PutUint64(buf[0:], uint64(q.head.segment))
+	binary.BigEndian.PutUint64(buf[8:], uint64(q.head.offset))
+	binary.BigEndian.PutUint32(buf[16:], crc32.Checksum(buf[:16], castagnoliTable))
+
+	path := filepath.Join(q.cfg.Directory, checkpointFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if q.cfg.Fsync == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for _, e := range entries {
+		if e.IsDir() || len(e.Name()) != segmentNameLen {
+			continue
+		}
+		if index, err := strconv.Atoi(e.Name()); err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// repairSegment truncates the segment after its last intact record and returns its size.
+func repairSegment(path string, segmentSize int64) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var valid int64
+	for valid < info.Size() {
+		payload, err := readRecord(io.NewSectionReader(f, valid, info.Size()-valid), segmentSize)
+		if err != nil {
+			break
+		}
+		valid += int64(recordHeaderSize + len(payload))
+	}
+	if valid < info.Size() {
+		if err := f.Truncate(valid); err != nil {
+			return 0, err
+		}
+	}
+	return valid, nil
+}
+
+// countRecords counts the records of the segment at path between offset from and size, by
+// their headers. It stops at the first one that can't be framed.
+func countRecords(path string, from, size int64) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	n := 0
+	var header [recordHeaderSize]byte
+	for off := from; off+recordHeaderSize <= size; n++ {
+		if _, err := f.ReadAt(header[:], off); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:]))
+		if length == 0 || off+recordHeaderSize+length > size {
+			break
+		}
+		off += recordHeaderSize + length
+	}
+	return n
+}
+
+// readRecord reads the record at the start of r. The length in its header is checked
+// against what is left of r and the segment size before anything is allocated, so a torn
+// header can't make it allocate gigabytes. Append never writes empty records: a zero
+// length is a zero-filled tail left by a crash, whose checksum would match.
+func readRecord(r *io.SectionReader, segmentSize int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errCorruptData
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:]))
+	if length == 0 || length > r.Size()-recordHeaderSize || recordHeaderSize+length > segmentSize {
+		return nil, errCorruptData
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errCorruptData
+	}
+	if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errCorruptData
+	}
+	return payload, nil
+}
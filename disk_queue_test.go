@@ -0,0 +1,270 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+func testDiskQueueConfig(dir string) DiskQueueConfig {
+	return DiskQueueConfig{
+		Directory:   dir,
+		SegmentSize: 64,
+		MaxSize:     1024,
+		Fsync:       FsyncAlways,
+	}
+}
+
+// drain reads and acknowledges everything left in the queue.
+func drain(t *testing.T, q *DiskQueue) []string {
+	var records []string
+	for {
+		payload, err := q.Peek()
+		if err == errQueueEmpty {
+			return records
+		}
+		require.NoError(t, err)
+		records = append(records, string(payload))
+		require.NoError(t, q.Ack())
+	}
+}
+
+func appendRecords(t *testing.T, q *DiskQueue, from, to int) {
+	for i := from; i < to; i++ {
+		_, err := q.Append([]byte(fmt.Sprintf("record-%02d", i)))
+		require.NoError(t, err)
+	}
+}
+
+func TestDiskQueueReplaysUnacknowledgedRecordsAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, q, 0, 10)
+
+	// Acknowledge the first three, then "crash": the queue is never closed.
+	for i := 0; i < 3; i++ {
+		_, err := q.Peek()
+		require.NoError(t, err)
+		require.NoError(t, q.Ack())
+	}
+
+	q, err = OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	records := drain(t, q)
+	require.Len(t, records, 7)
+	assert.Equal(t, "record-03", records[0])
+	assert.Equal(t, "record-09", records[6])
+
+	// New records go after the replayed ones.
+	appendRecords(t, q, 10, 12)
+	assert.Equal(t, []string{"record-10", "record-11"}, drain(t, q))
+	require.NoError(t, q.Close())
+}
+
+func TestDiskQueueRecoversFromTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, q, 0, 3)
+
+	// Simulate a crash in the middle of a write: a header announcing more than was written.
+	indexes, err := listSegments(dir)
+	require.NoError(t, err)
+	last := filepath.Join(dir, fmt.Sprintf("%08d", indexes[len(indexes)-1]))
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2, 3, 4, 'p', 'a', 'r'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, q, 3, 4)
+	assert.Equal(t, []string{"record-00", "record-01", "record-02", "record-03"}, drain(t, q))
+}
+
+func TestDiskQueueTruncatesZeroFilledTail(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, q, 0, 2)
+
+	// Simulate a crash after the file was extended but before the data reached it: the
+	// checksum of an empty payload is 0, so the zeroes would frame valid empty records.
+	indexes, err := listSegments(dir)
+	require.NoError(t, err)
+	last := filepath.Join(dir, fmt.Sprintf("%08d", indexes[len(indexes)-1]))
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 3*recordHeaderSize))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-00", "record-01"}, drain(t, q))
+	info, err := os.Stat(last)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*(recordHeaderSize+len("record-00"))), info.Size())
+}
+
+func TestDiskQueueRejectsOversizedRecordLength(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, q, 0, 1)
+	require.NoError(t, q.Close())
+
+	// A torn header announcing 4 GiB must be cut off without allocating it.
+	path := filepath.Join(dir, fmt.Sprintf("%08d", 0))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = OpenDiskQueue(testDiskQueueConfig(dir))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-00"}, drain(t, q))
+	_, err = q.Append(nil)
+	assert.Error(t, err)
+}
+
+func TestDiskQueueTruncatesAtChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testDiskQueueConfig(dir)
+	cfg.SegmentSize = 1024
+	cfg.MaxSize = 4096
+	q, err := OpenDiskQueue(cfg)
+	require.NoError(t, err)
+	appendRecords(t, q, 0, 3)
+	require.NoError(t, q.Close())
+
+	// Flip a byte in the payload of the second record.
+	path := filepath.Join(dir, fmt.Sprintf("%08d", 0))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	recLen := recordHeaderSize + len("record-00")
+	data[recLen+recordHeaderSize] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o640))
+
+	q, err = OpenDiskQueue(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-00"}, drain(t, q))
+}
+
+func TestDiskQueueEvictsOldestSegments(t *testing.T) {
+	cfg := testDiskQueueConfig(t.TempDir())
+	cfg.MaxSize = 128
+	q, err := OpenDiskQueue(cfg)
+	require.NoError(t, err)
+
+	// Each segment holds 3 records of 17 bytes, the queue two segments.
+	appendRecords(t, q, 0, 20)
+	assert.LessOrEqual(t, q.Size(), cfg.MaxSize)
+	assert.Greater(t, q.Evicted(), int64(0))
+
+	records := drain(t, q)
+	assert.Equal(t, "record-19", records[len(records)-1])
+	assert.NotEqual(t, "record-00", records[0], "the oldest records should have been evicted")
+	assert.Equal(t, int64(20-len(records)), q.EvictedRecords())
+
+	// Records acknowledged before their segment is evicted were not lost.
+	evicted := q.EvictedRecords()
+	appendRecords(t, q, 20, 23)
+	_, err = q.Peek()
+	require.NoError(t, err)
+	require.NoError(t, q.Ack())
+	appendRecords(t, q, 23, 40)
+	records = drain(t, q)
+	assert.Equal(t, int64(40-20-1-len(records)), q.EvictedRecords()-evicted)
+}
+
+func TestQueueManagerReplaysPersistedRequestsOnStartup(t *testing.T) {
+	var (
+		healthy  atomic.Bool
+		received atomic.Int64
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := testQueueConfig()
+	cfg.PersistentQueue = DefaultDiskQueueConfig(t.TempDir())
+	clientCfg := httpClientConfig{Endpoint: server.URL, Retry: testRetryConfig()}
+	clientCfg.Retry.MaxElapsedTime = 10 * time.Millisecond
+
+	// The endpoint is down for the whole life of the first queue manager.
+	qm, err := NewQueueManager(cfg, clientCfg, zap.NewNop())
+	require.NoError(t, err)
+	qm.Start()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, qm.Append(context.Background(), []prompb.Label{{Name: "series", Value: fmt.Sprint(i)}}, typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1}}}))
+	}
+	qm.Stop(context.Background())
+	assert.Equal(t, int64(0), received.Load())
+
+	healthy.Store(true)
+	qm, err = NewQueueManager(cfg, clientCfg, zap.NewNop())
+	require.NoError(t, err)
+	qm.Start()
+	assert.Eventually(t, func() bool {
+		_, err := qm.diskQueue.Peek()
+		return err == errQueueEmpty
+	}, 5*time.Second, 10*time.Millisecond)
+	qm.Stop(context.Background())
+	assert.Greater(t, received.Load(), int64(0))
+
+	q, err := OpenDiskQueue(cfg.PersistentQueue)
+	require.NoError(t, err)
+	assert.Empty(t, drain(t, q), "everything should have been delivered")
+}
+
+func TestQueueManagerReportsEvictedRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := testQueueConfig()
+	cfg.MinShards, cfg.MaxSamplesPerSend = 1, 1
+	cfg.PersistentQueue = DefaultDiskQueueConfig(t.TempDir())
+	cfg.PersistentQueue.SegmentSize, cfg.PersistentQueue.MaxSize = 256, 512
+	clientCfg := httpClientConfig{Endpoint: server.URL, Retry: testRetryConfig()}
+	core, logs := observer.New(zap.WarnLevel)
+	qm, err := NewQueueManager(cfg, clientCfg, zap.New(core))
+	require.NoError(t, err)
+	qm.Start()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, qm.Append(context.Background(), []prompb.Label{{Name: "series", Value: fmt.Sprint(i)}}, typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1}}}))
+	}
+	require.NoError(t, qm.Stop(context.Background()))
+
+	assert.Positive(t, qm.RequestsEvicted())
+	assert.Equal(t, qm.diskQueue.EvictedRecords(), qm.RequestsEvicted())
+	evicted := int64(0)
+	for _, entry := range logs.FilterMessageSnippet("Evicted requests").All() {
+		evicted += entry.ContextMap()["requests"].(int64)
+	}
+	assert.Equal(t, qm.RequestsEvicted(), evicted)
+}
@@ -0,0 +1,78 @@
+package prometheusremotewritev2
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/multierr"
+)
+
+// DropReason tells why data points were left out of a request.
+type DropReason string
+
+const (
+	ReasonUnsupportedMetricType DropReason = "unsupported_metric_type"
+	ReasonInvalidLabel          DropReason = "invalid_label"
+	ReasonInvalidHistogram      DropReason = "invalid_histogram"
+	ReasonSymbolOverflow        DropReason = "symbol_overflow"
+	ReasonLabelTooLong          DropReason = "label_too_long"
+	ReasonSeriesTooLarge        DropReason = "series_too_large"
+)
+
+// The errors a ConversionError wraps, one per DropReason, to be matched with errors.Is.
+var (
+	ErrUnsupportedMetricType = errors.New("unsupported metric type")
+	ErrInvalidLabel          = errors.New("invalid label")
+	ErrInvalidHistogram      = errors.New("invalid histogram")
+	ErrSymbolOverflow        = errors.New("symbol overflow")
+	ErrLabelTooLong          = errors.New("label too long")
+	ErrSeriesTooLarge        = errors.New("series does not fit in a request on its own")
+)
+
+var reasonErrors = map[DropReason]error{
+	ReasonUnsupportedMetricType: ErrUnsupportedMetricType,
+	ReasonInvalidLabel:          ErrInvalidLabel,
+	ReasonInvalidHistogram:      ErrInvalidHistogram,
+	ReasonSymbolOverflow:        ErrSymbolOverflow,
+	ReasonLabelTooLong:          ErrLabelTooLong,
+	ReasonSeriesTooLarge:        ErrSeriesTooLarge,
+}
+
+// ConversionError reports data points of a metric that could not be converted.
+type ConversionError struct {
+	Reason DropReason
+	Metric string
+	// Points is the number of data points dropped.
+	Points int
+	err    error
+}
+
+func newConversionError(reason DropReason, metric string, points int, format string, args ...any) *ConversionError {
+	return &ConversionError{
+		Reason: reason,
+		Metric: metric,
+		Points: points,
+		err:    fmt.Errorf("%w: %s", reasonErrors[reason], fmt.Sprintf(format, args...)),
+	}
+}
+
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("metric %q: %d data point(s) dropped: %v", e.Metric, e.Points, e.err)
+}
+
+func (e *ConversionError) Unwrap() error {
+	return e.err
+}
+
+// DroppedPoints adds up the data points dropped per reason by the conversion errors
+// aggregated in err.
+func DroppedPoints(err error) map[DropReason]int {
+	dropped := make(map[DropReason]int)
+	for _, e := range multierr.Errors(err) {
+		var convErr *ConversionError
+		if errors.As(e, &convErr) {
+			dropped[convErr.Reason] += convErr.Points
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,79 @@
+package prometheusremotewritev2
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+func TestBuildSkipsBadPointsAndReportsWhy(t *testing.T) {
+	md := PrepareDummyExportRequest().Metrics()
+	rm := md.ResourceMetrics().At(0)
+	metrics := rm.ScopeMetrics().At(0).Metrics()
+
+	// One of three points of a series can't be a native histogram.
+	points := metrics.At(0).ExponentialHistogram().DataPoints()
+	badPoint := points.AppendEmpty()
+	points.At(0).Attributes().CopyTo(badPoint.Attributes())
+	badPoint.SetScale(-5)
+	points.At(0).Attributes().CopyTo(points.AppendEmpty().Attributes())
+
+	// A data point attribute clashing with a resource attribute.
+	clash := metrics.AppendEmpty()
+	clash.SetName("clashing-labels")
+	dp := clash.SetEmptyExponentialHistogram().DataPoints().AppendEmpty()
+	dp.Attributes().PutStr("demo-resource-name-1", "other")
+
+	gauge := metrics.AppendEmpty()
+	gauge.SetName("gauge")
+	gauge.SetEmptyGauge()
+	for i := 0; i < 3; i++ {
+		gauge.Gauge().DataPoints().AppendEmpty()
+	}
+
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+	require.NoError(t, err)
+	builder.Add(md)
+	req, err := builder.Build()
+
+	assert.Len(t, req.Timeseries, 5, "the other metrics should still be converted")
+	assert.Len(t, req.Timeseries[indexOfSeriesWithHistograms(req.Timeseries, 2)].Histograms, 2)
+
+	assert.True(t, errors.Is(err, ErrInvalidHistogram))
+	assert.True(t, errors.Is(err, ErrInvalidLabel))
+	assert.True(t, errors.Is(err, ErrUnsupportedMetricType))
+	assert.False(t, errors.Is(err, ErrSymbolOverflow))
+	assert.Equal(t, map[DropReason]int{
+		ReasonInvalidHistogram:      1,
+		ReasonInvalidLabel:          1,
+		ReasonUnsupportedMetricType: 3,
+	}, DroppedPoints(err))
+
+	var convErr *ConversionError
+	require.True(t, errors.As(err, &convErr))
+	assert.NotEmpty(t, convErr.Metric)
+}
+
+func TestValidateExponentialHistogram(t *testing.T) {
+	dp := pmetric.NewExponentialHistogramDataPoint()
+	dp.SetCount(3)
+	dp.SetZeroCount(1)
+	dp.Positive().BucketCounts().FromRaw([]uint64{1, 1})
+	assert.NoError(t, validateExponentialHistogram(dp))
+
+	dp.Negative().BucketCounts().FromRaw([]uint64{1})
+	assert.Error(t, validateExponentialHistogram(dp), "buckets hold more observations than the count")
+}
+
+func indexOfSeriesWithHistograms(series []typesv2.TimeSeries, n int) int {
+	for i, ts := range series {
+		if len(ts.Histograms) == n {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,56 @@
+package prometheusremotewritev2
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaRate tracks an exponentially weighted moving average of a per-second rate, the same
+// way Prometheus' remote storage does to decide how many shards it needs.
+type ewmaRate struct {
+	newEvents atomic.Int64
+
+	alpha    float64
+	interval time.Duration
+	lastRate float64
+	init     bool
+	mutex    sync.Mutex
+}
+
+// newEWMARate always allocates a new ewmaRate, as this guarantees the atomically accessed
+// int64 will be aligned on ARM.
+func newEWMARate(alpha float64, interval time.Duration) *ewmaRate {
+	return &ewmaRate{
+		alpha:    alpha,
+		interval: interval,
+	}
+}
+
+// rate returns the per-second rate.
+func (r *ewmaRate) rate() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastRate
+}
+
+// tick assumes to be called every r.interval.
+func (r *ewmaRate) tick() {
+	newEvents := r.newEvents.Swap(0)
+	instantRate := float64(newEvents) / r.interval.Seconds()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.init {
+		r.lastRate += r.alpha * (instantRate - r.lastRate)
+	} else if newEvents > 0 {
+		r.init = true
+		r.lastRate = instantRate
+	}
+}
+
+// incr counts some events.
+func (r *ewmaRate) incr(incr int64) {
+	r.newEvents.Add(incr)
+}
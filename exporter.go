@@ -0,0 +1,109 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// prwExporter converts the metrics it is handed with a V2WriteRequestBuilder and feeds the
+// resulting series to a QueueManager, which encodes and sends them.
+type prwExporter struct {
+	cfg    *Config
+	logger *zap.Logger
+	qm     *QueueManager
+	// builders holds the builders of the previous pushes, whose memory is reused.
+	builders sync.Pool
+
+	droppedMtx sync.Mutex
+	dropped    map[DropReason]int
+}
+
+func newPRWExporter(cfg *Config, logger *zap.Logger) *prwExporter {
+	return &prwExporter{cfg: cfg, logger: logger, dropped: make(map[DropReason]int)}
+}
+
+func (prwe *prwExporter) start(_ context.Context, _ component.Host) error {
+	qm, err := NewQueueManager(prwe.cfg.Queue, prwe.cfg.clientConfig(), prwe.logger)
+	if err != nil {
+		return err
+	}
+	qm.Start()
+	prwe.qm = qm
+	return nil
+}
+
+// shutdown flushes the series still buffered by the queue manager, until ctx is done.
+func (prwe *prwExporter) shutdown(ctx context.Context) error {
+	if prwe.qm == nil {
+		return nil
+	}
+	return prwe.qm.Stop(ctx)
+}
+
+func (prwe *prwExporter) pushMetrics(ctx context.Context, md pmetric.Metrics) error {
+	builder, ok := prwe.builders.Get().(*V2WriteRequestBuilder)
+	if !ok {
+		var err error
+		if builder, err = NewV2WriteRequestBuilder(prwe.cfg.clientConfig()); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		builder.Reset()
+		prwe.builders.Put(builder)
+	}()
+
+	builder.Add(md)
+	var convErrs, queueErrs error
+	for _, err := range multierr.Errors(builder.Enqueue(ctx, prwe.qm)) {
+		var convErr *ConversionError
+		if errors.As(err, &convErr) {
+			convErrs = multierr.Append(convErrs, err)
+		} else {
+			queueErrs = multierr.Append(queueErrs, err)
+		}
+	}
+	prwe.reportDropped(convErrs)
+
+	// Data points that can't be converted never will be, they are only reported: failing
+	// the push would count the whole batch as dropped. If ctx ran out before every series
+	// was queued, a retry sends the queued ones again, which receivers take as duplicates.
+	if errors.Is(queueErrs, errQueueStopped) {
+		return consumererror.NewPermanent(queueErrs)
+	}
+	return queueErrs
+}
+
+// reportDropped logs the data points left out by the conversion and adds them up.
+func (prwe *prwExporter) reportDropped(err error) {
+	dropped := DroppedPoints(err)
+	if len(dropped) == 0 {
+		return
+	}
+	prwe.droppedMtx.Lock()
+	for reason, points := range dropped {
+		prwe.dropped[reason] += points
+	}
+	prwe.droppedMtx.Unlock()
+
+	fields := make([]zap.Field, 0, len(dropped)+1)
+	for reason, points := range dropped {
+		fields = append(fields, zap.Int(string(reason), points))
+	}
+	prwe.logger.Warn("Dropped data points that could not be converted", append(fields, zap.Error(err))...)
+}
+
+// droppedPoints is the number of data points dropped by the conversion so far, per reason.
+func (prwe *prwExporter) droppedPoints() map[DropReason]int {
+	prwe.droppedMtx.Lock()
+	defer prwe.droppedMtx.Unlock()
+	return maps.Clone(prwe.dropped)
+}
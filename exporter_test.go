@@ -0,0 +1,205 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/confmap"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/exporter/exportertest"
+	"go.uber.org/zap"
+	"prometheusrwexporter-demo/otlpgen"
+	"prometheusrwexporter-demo/rwtest"
+)
+
+func TestCreateDefaultConfig(t *testing.T) {
+	cfg := NewFactory().CreateDefaultConfig()
+	assert.NoError(t, componenttest.CheckConfigStruct(cfg))
+	assert.Error(t, cfg.(*Config).Validate(), "the endpoint has no default")
+
+	cfg.(*Config).Endpoint = "http://localhost:9090/api/v1/write"
+	assert.NoError(t, cfg.(*Config).Validate())
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{"relative endpoint", func(cfg *Config) { cfg.Endpoint = "/api/v1/write" }},
+		{"unsupported scheme", func(cfg *Config) { cfg.Endpoint = "ftp://localhost" }},
+		{"negative timeout", func(cfg *Config) { cfg.Timeout = -time.Second }},
+		{"negative conversion workers", func(cfg *Config) { cfg.ConversionWorkers = -1 }},
+		{"unknown series order", func(cfg *Config) { cfg.SeriesOrder = "random" }},
+		{"negative limit", func(cfg *Config) { cfg.Limits.MaxBytes = -1 }},
+		{"invalid retry", func(cfg *Config) { cfg.Retry.Multiplier = 0.5 }},
+		{"invalid queue", func(cfg *Config) { cfg.Queue.MaxShards = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createDefaultConfig().(*Config)
+			cfg.Endpoint = "http://localhost:9090/api/v1/write"
+			tt.modify(cfg)
+			assert.Error(t, cfg.Validate())
+		})
+	}
+}
+
+func TestUnmarshalConfig(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	conf := confmap.NewFromStringMap(map[string]any{
+		"endpoint": "https://gateway:8080/api/v1/write",
+		"limits":   map[string]any{"max_bytes": 4 << 20},
+		"remote_write_queue": map[string]any{
+			"max_shards":       10,
+			"persistent_queue": map[string]any{"directory": "/var/lib/prw", "fsync": "always"},
+		},
+	})
+	require.NoError(t, conf.Unmarshal(cfg))
+
+	assert.Equal(t, 4<<20, cfg.Limits.MaxBytes)
+	assert.Equal(t, 10, cfg.Queue.MaxShards)
+	assert.Equal(t, DefaultQueueConfig().Capacity, cfg.Queue.Capacity, "unset fields should keep their default")
+	assert.Equal(t, FsyncAlways, cfg.Queue.PersistentQueue.Fsync)
+}
+
+func TestMetricsExporterSendsMetrics(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		series int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, contentTypeV2, r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		req, err := snappyEncoder{}.Decode(body)
+		assert.NoError(t, err)
+		mtx.Lock()
+		series += len(req.Timeseries)
+		mtx.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	factory := NewFactory()
+	cfg := factory.CreateDefaultConfig().(*Config)
+	cfg.Endpoint = server.URL
+	require.NoError(t, cfg.Validate())
+
+	exp, err := factory.CreateMetricsExporter(context.Background(), exportertest.NewNopSettings(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, exp.Start(context.Background(), componenttest.NewNopHost()))
+
+	require.NoError(t, exp.ConsumeMetrics(context.Background(), PrepareDummyExportRequest().Metrics()))
+	require.NoError(t, exp.Shutdown(context.Background()))
+
+	assert.Equal(t, 5, series, "shutdown should flush every series")
+}
+
+func TestMetricsExporterReportsUnsupportedMetricsWithoutFailing(t *testing.T) {
+	server := rwtest.NewServer()
+	defer server.Close()
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.Endpoint = server.URL
+	prwe := newPRWExporter(cfg, zap.NewNop())
+	require.NoError(t, prwe.start(context.Background(), componenttest.NewNopHost()))
+
+	genCfg := otlpgen.DefaultConfig()
+	md, err := otlpgen.Generate(genCfg)
+	require.NoError(t, err)
+	assert.NoError(t, prwe.pushMetrics(context.Background(), md), "the exponential histograms were queued")
+	require.NoError(t, prwe.shutdown(context.Background()))
+	require.NoError(t, prwe.shutdown(context.Background()), "shutting down twice should be harmless")
+
+	unsupported := genCfg.Gauges + genCfg.Sums + genCfg.Histograms + genCfg.Summaries
+	assert.Equal(t, map[DropReason]int{ReasonUnsupportedMetricType: unsupported * genCfg.SeriesPerMetric}, prwe.droppedPoints())
+	series := 0
+	for _, req := range server.Requests() {
+		series += len(req.Timeseries)
+	}
+	assert.Equal(t, genCfg.ExponentialHistograms*genCfg.SeriesPerMetric, series)
+
+	err = prwe.pushMetrics(context.Background(), md)
+	assert.True(t, consumererror.IsPermanent(err), "pushing after shutdown should fail for good, got %v", err)
+}
+
+func TestShutdownGivesUpOnceContextIsDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.Endpoint = server.URL
+	cfg.Retry.MaxInterval = time.Second
+	prwe := newPRWExporter(cfg, zap.NewNop())
+	require.NoError(t, prwe.start(context.Background(), componenttest.NewNopHost()))
+	require.NoError(t, prwe.pushMetrics(context.Background(), PrepareDummyExportRequest().Metrics()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	err := prwe.shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(begin), time.Second, "the retries should have been abandoned")
+	assert.Equal(t, int64(5), prwe.qm.SeriesFailed())
+	assert.Zero(t, prwe.qm.SeriesSent())
+}
+
+// discardTransport answers every request with 204 without sending it anywhere.
+type discardTransport struct{}
+
+func (discardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, _ = io.Copy(io.Discard, req.Body)
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+}
+
+// TestPushMetricsAllocs measures the allocations of a push of a warmed up exporter, from
+// the conversion to the request being sent, with a single request per push. The generated
+// Marshal allocates a scratch buffer for every packed field it encodes, the label references
+// of a series and the bucket deltas of a histogram; what is left is per request: the encoded
+// and compressed payloads and the HTTP request.
+func TestPushMetricsAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	md := generateWorkload(t, 1)
+	w := benchWorkloads[1]
+	series, samples := w.resources*w.metrics, w.resources*w.metrics*w.points
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.Endpoint = "http://localhost/api/v1/write"
+	cfg.Queue.MinShards, cfg.Queue.MaxShards = 1, 1
+	cfg.Queue.MaxSamplesPerSend = samples
+	prwe := newPRWExporter(cfg, zap.NewNop())
+	require.NoError(t, prwe.start(context.Background(), componenttest.NewNopHost()))
+	defer func() { require.NoError(t, prwe.shutdown(context.Background())) }()
+	prwe.qm.client.Transport = discardTransport{}
+
+	push := func() {
+		sent := prwe.qm.SeriesSent()
+		require.NoError(t, prwe.pushMetrics(context.Background(), md))
+		deadline := time.Now().Add(10 * time.Second)
+		for prwe.qm.SeriesSent() < sent+int64(series) {
+			require.Zero(t, prwe.qm.SeriesFailed(), "sending failed: %v", prwe.qm.LastError())
+			require.True(t, time.Now().Before(deadline), "the series were not sent in time")
+			runtime.Gosched()
+		}
+	}
+	push()
+	allocs := testing.AllocsPerRun(20, push)
+	t.Logf("%.0f allocations per push of %d series", allocs, series)
+	histograms := samples // every point of the workload is an exponential histogram
+	assert.LessOrEqual(t, allocs, float64(series+histograms+100),
+		"only the marshalling of a series should allocate once the exporter is warmed up")
+	assert.Zero(t, prwe.qm.SeriesFailed())
+}
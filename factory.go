@@ -0,0 +1,49 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/exporter"
+	"go.opentelemetry.io/collector/exporter/exporterhelper"
+)
+
+var componentType = component.MustNewType("prometheusremotewritev2")
+
+const stability = component.StabilityLevelDevelopment
+
+// NewFactory creates the factory of the Prometheus Remote Write 2.0 exporter.
+func NewFactory() exporter.Factory {
+	return exporter.NewFactory(
+		componentType,
+		createDefaultConfig,
+		exporter.WithMetrics(createMetricsExporter, stability),
+	)
+}
+
+func createDefaultConfig() component.Config {
+	return &Config{
+		Timeout: 5 * time.Second,
+		Retry:   DefaultRetryConfig(),
+		Queue:   DefaultQueueConfig(),
+	}
+}
+
+func createMetricsExporter(ctx context.Context, set exporter.Settings, cfg component.Config) (exporter.Metrics, error) {
+	prwe := newPRWExporter(cfg.(*Config), set.Logger)
+
+	// Retries, queueing and timeouts are taken care of by the queue manager, the helper
+	// only has to hand the metrics over.
+	return exporterhelper.NewMetricsExporter(
+		ctx,
+		set,
+		cfg,
+		prwe.pushMetrics,
+		exporterhelper.WithCapabilities(consumer.Capabilities{MutatesData: false}),
+		exporterhelper.WithTimeout(exporterhelper.TimeoutSettings{Timeout: 0}),
+		exporterhelper.WithStart(prwe.start),
+		exporterhelper.WithShutdown(prwe.shutdown),
+	)
+}
@@ -0,0 +1,74 @@
+package prometheusremotewritev2
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"prometheusrwexporter-demo/otlpgen"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func goldenMetrics(t *testing.T) pmetric.Metrics {
+	cfg := otlpgen.DefaultConfig()
+	cfg.Resources = 16
+	cfg.ResourceAttributes = 2
+	cfg.Gauges, cfg.Sums, cfg.Histograms, cfg.Summaries = 0, 0, 0, 0
+	cfg.ExponentialHistograms = 2
+	cfg.SeriesPerMetric = 1
+	cfg.Attributes = 2
+	cfg.DataPointsPerSeries = 2
+	md, err := otlpgen.Generate(cfg)
+	require.NoError(t, err)
+	return md
+}
+
+// reversed returns the metrics with their resources in reverse order.
+func reversed(md pmetric.Metrics) pmetric.Metrics {
+	out := pmetric.NewMetrics()
+	for i := md.ResourceMetrics().Len() - 1; i >= 0; i-- {
+		md.ResourceMetrics().At(i).CopyTo(out.ResourceMetrics().AppendEmpty())
+	}
+	return out
+}
+
+func TestBuildGolden(t *testing.T) {
+	md := goldenMetrics(t)
+	for _, tt := range []struct {
+		name    string
+		golden  string
+		order   SeriesOrder
+		md      pmetric.Metrics
+		workers int
+	}{
+		{"input order", "request_input_order.pb", SeriesOrderInput, md, 1},
+		{"input order, parallel", "request_input_order.pb", SeriesOrderInput, md, 2},
+		{"label order", "request_label_order.pb", SeriesOrderLabels, md, 1},
+		{"label order, parallel", "request_label_order.pb", SeriesOrderLabels, md, 2},
+		{"label order, reversed input", "request_label_order.pb", SeriesOrderLabels, reversed(md), 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := NewV2WriteRequestBuilder(httpClientConfig{SeriesOrder: tt.order, ConversionWorkers: tt.workers})
+			require.NoError(t, err)
+			builder.Add(tt.md)
+			req, err := builder.Build()
+			require.NoError(t, err)
+			pBuf, err := req.Marshal()
+			require.NoError(t, err)
+
+			path := filepath.Join("testdata", tt.golden)
+			if *updateGolden && tt.md == md && tt.workers == 1 {
+				require.NoError(t, os.MkdirAll("testdata", 0o755))
+				require.NoError(t, os.WriteFile(path, pBuf, 0o644))
+			}
+			golden, err := os.ReadFile(path)
+			require.NoError(t, err, "run go test -run TestBuildGolden -update to create it")
+			assert.Equal(t, golden, pBuf, "the request differs from %s, run go test -run TestBuildGolden -update if that is expected", path)
+		})
+	}
+}
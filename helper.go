@@ -1,9 +1,16 @@
 package prometheusremotewritev2
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/prompb"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
@@ -11,45 +18,472 @@ import (
 	typesv2 "prometheusrwexporter-demo/types"
 )
 
-// Since we are assuming that for one metric all its datapoints are from the same TimeSeries
-// So just getting the attributes from the first datapoint is enough.
-func getLabelsFromExpDataPoints(dp pmetric.ExponentialHistogramDataPointSlice) (labels []prompb.Label) {
-	return getLabelsFromAttrs(dp.At(0).Attributes())
+// pointGroups groups the data points of a metric into series, one per attribute set. Its
+// memory is kept from one metric to the next.
+type pointGroups struct {
+	groupOfHash map[uint64]int
+	groups      []pointGroup
+	pointGroup  []int
+	// points holds the indices of the data points, series after series.
+	points []int
 }
 
-func getLabelsFromAttrs(attributes pcommon.Map) []prompb.Label {
-	labels := make([]prompb.Label, attributes.Len())
-	attributes.Range(func(k string, v pcommon.Value) bool {
-		for i := 0; i < attributes.Len(); i++ {
-			labels[i].Name = k
-			labels[i].Value = v.AsString()
-			return true
+type pointGroup struct {
+	hash         uint64
+	attrs        pcommon.Map
+	start, count int
+}
+
+// group groups the n data points whose attributes are returned by attrs. The series come in
+// the order of their first data point, and the points of a series in their order.
+func (pg *pointGroups) group(n int, attrs func(i int) pcommon.Map) {
+	if pg.groupOfHash == nil {
+		pg.groupOfHash = make(map[uint64]int)
+	}
+	pg.reset()
+	for i := 0; i < n; i++ {
+		a := attrs(i)
+		h := attributesHash(a)
+		g, ok := pg.groupOfHash[h]
+		if ok && !attributesEqual(pg.groups[g].attrs, a) {
+			// Another attribute set has the same hash, look through all of them.
+			ok = false
+			for j := g + 1; j < len(pg.groups); j++ {
+				if pg.groups[j].hash == h && attributesEqual(pg.groups[j].attrs, a) {
+					g, ok = j, true
+					break
+				}
+			}
 		}
+		if !ok {
+			g = len(pg.groups)
+			pg.groups = append(pg.groups, pointGroup{hash: h, attrs: a})
+			if _, seen := pg.groupOfHash[h]; !seen {
+				pg.groupOfHash[h] = g
+			}
+		}
+		pg.groups[g].count++
+		pg.pointGroup = append(pg.pointGroup, g)
+	}
+
+	start := 0
+	for g := range pg.groups {
+		pg.groups[g].start, start = start, start+pg.groups[g].count
+		pg.groups[g].count = 0
+	}
+	pg.points = slices.Grow(pg.points[:0], n)[:n]
+	for i, g := range pg.pointGroup {
+		group := &pg.groups[g]
+		pg.points[group.start+group.count] = i
+		group.count++
+	}
+}
+
+// series returns the attributes and the indices of the data points of the g-th series.
+func (pg *pointGroups) series(g int) (pcommon.Map, []int) {
+	group := pg.groups[g]
+	return group.attrs, pg.points[group.start : group.start+group.count]
+}
+
+// reset forgets the data points grouped, so that their metric can be garbage collected.
+func (pg *pointGroups) reset() {
+	clear(pg.groupOfHash)
+	clear(pg.groups)
+	pg.groups = pg.groups[:0]
+	pg.pointGroup = pg.pointGroup[:0]
+}
+
+// attributesHash hashes the attributes as the labels they become, whatever their order.
+func attributesHash(attrs pcommon.Map) uint64 {
+	var sum uint64
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		h := fnvString(fnvOffset64, k)
+		h = fnvString((h^0xff)*fnvPrime64, v.AsString())
+		sum += h
+		return true
+	})
+	return sum
+}
+
+// attributesEqual tells whether two attribute sets become the same labels.
+func attributesEqual(a, b pcommon.Map) bool {
+	if a.Len() != b.Len() {
 		return false
+	}
+	equal := true
+	a.Range(func(k string, v pcommon.Value) bool {
+		other, ok := b.Get(k)
+		equal = ok && other.AsString() == v.AsString()
+		return equal
+	})
+	return equal
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnvString adds s to the FNV-1a hash h.
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * fnvPrime64
+	}
+	return h
+}
+
+// appendLabelsFromAttrs appends the attributes to labels, as labels.
+func appendLabelsFromAttrs(labels []prompb.Label, attributes pcommon.Map) []prompb.Label {
+	attributes.Range(func(k string, v pcommon.Value) bool {
+		labels = append(labels, prompb.Label{Name: k, Value: v.AsString()})
+		return true
 	})
 
 	return labels
 }
 
-func exponentialToNativeHistogram(p pmetric.ExponentialHistogramDataPoint) typesv2.Histogram {
-	// return a dummy histogram
-	return typesv2.Histogram{
-		Sum:    p.Sum(),
-		Schema: 7,
+// applyLabelLimits enforces the maximum label name and value lengths of limits, either by
+// truncating the offending labels or by returning an error if the series should be dropped.
+func applyLabelLimits(labels []prompb.Label, limits RequestLimits) ([]prompb.Label, error) {
+	tooLong := func(s string, max int) bool {
+		return max > 0 && len(s) > max
 	}
+	for i, l := range labels {
+		if !tooLong(l.Name, limits.MaxLabelNameLength) && !tooLong(l.Value, limits.MaxLabelValueLength) {
+			continue
+		}
+		if limits.LabelLimitAction == LabelLimitDrop {
+			return nil, fmt.Errorf("label %q with a value of %d bytes exceeds the length limits", truncateUTF8(l.Name, 64), len(l.Value))
+		}
+		if tooLong(l.Name, limits.MaxLabelNameLength) {
+			labels[i].Name = truncateUTF8(l.Name, limits.MaxLabelNameLength)
+		}
+		if tooLong(l.Value, limits.MaxLabelValueLength) {
+			labels[i].Value = truncateUTF8(l.Value, limits.MaxLabelValueLength)
+		}
+	}
+	return labels, nil
 }
 
-func nativeToExponentialHistogram(p typesv2.Histogram) (h pmetric.ExponentialHistogramDataPoint) {
-    // return a dummy ExponentialHistogramDataPoint
-	ts := pcommon.NewTimestampFromTime(time.Now())
-	h.SetTimestamp(ts)
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
 
-	// Set 50 samples, 10 each with values 0.5, 1, 2, 4, and 8
-	h.SetCount(50)
-	h.SetSum(155)
-	h.Positive().BucketCounts().FromRaw([]uint64{10, 10, 10, 10, 10, 0})
-	return h
+// validateLabels checks a sorted label set: names must not be empty or repeated, and
+// neither names nor values may be invalid UTF-8.
+func validateLabels(labels []prompb.Label) error {
+	for i, l := range labels {
+		if l.Name == "" {
+			return errors.New("empty label name")
+		}
+		if !utf8.ValidString(l.Name) || !utf8.ValidString(l.Value) {
+			return fmt.Errorf("label %q is not valid UTF-8", l.Name)
+		}
+		if i > 0 && labels[i-1].Name == l.Name {
+			return fmt.Errorf("duplicate label name %q", l.Name)
+		}
+	}
+	return nil
+}
+
+// validateExponentialHistogram checks that a point can be represented as a native histogram.
+func validateExponentialHistogram(p pmetric.ExponentialHistogramDataPoint) error {
+	// Finer scales can be downscaled, coarser ones have no native histogram schema.
+	if p.Scale() < -4 {
+		return fmt.Errorf("scale %d is lower than the lowest supported scale -4", p.Scale())
+	}
+	total := p.ZeroCount()
+	for _, buckets := range []pmetric.ExponentialHistogramDataPointBuckets{p.Positive(), p.Negative()} {
+		for i := 0; i < buckets.BucketCounts().Len(); i++ {
+			total += buckets.BucketCounts().At(i)
+		}
+	}
+	if total > p.Count() {
+		return fmt.Errorf("bucket counts add up to %d, more than the count %d", total, p.Count())
+	}
+	return nil
+}
+
+// dataPointCount is the number of data points of a metric of any type.
+func dataPointCount(metric pmetric.Metric) int {
+	switch metric.Type() {
+	case pmetric.MetricTypeGauge:
+		return metric.Gauge().DataPoints().Len()
+	case pmetric.MetricTypeSum:
+		return metric.Sum().DataPoints().Len()
+	case pmetric.MetricTypeHistogram:
+		return metric.Histogram().DataPoints().Len()
+	case pmetric.MetricTypeExponentialHistogram:
+		return metric.ExponentialHistogram().DataPoints().Len()
+	case pmetric.MetricTypeSummary:
+		return metric.Summary().DataPoints().Len()
+	}
+	return 0
+}
+
+// appendSeriesLabels puts together the label set of a series in labels: the resource
+// attributes, the metric name and the data point attributes, sorted by name as Prometheus
+// expects.
+func appendSeriesLabels(labels, resourceLabels []prompb.Label, name string, dpAttrs pcommon.Map) []prompb.Label {
+	labels = append(labels, resourceLabels...)
+	labels = append(labels, prompb.Label{Name: model.MetricNameLabel, Value: name})
+	labels = appendLabelsFromAttrs(labels, dpAttrs)
+	slices.SortFunc(labels, func(a, b prompb.Label) int { return strings.Compare(a.Name, b.Name) })
+
+	return labels
+}
+
+// maxNativeSchema is the finest native histogram schema, finer scales are downscaled to it.
+const maxNativeSchema = 8
+
+// appendNativeHistogram appends the point, converted into a native histogram, to dst. The
+// spans, deltas and counts of the histogram in the spare capacity of dst are reused.
+//
+// Native histogram schemas are exponential histogram scales, but bucket i of a native
+// histogram covers (base^(i-1), base^i] while OTLP bucket i covers (base^i, base^(i+1)],
+// hence the offset by one; see nativeToExponentialHistogram for the other way around.
+func appendNativeHistogram(dst []typesv2.Histogram, p pmetric.ExponentialHistogramDataPoint) []typesv2.Histogram {
+	dst = slices.Grow(dst, 1)[:len(dst)+1]
+	h := &dst[len(dst)-1]
+
+	scale, scaleDown := p.Scale(), int32(0)
+	if scale > maxNativeSchema {
+		scale, scaleDown = maxNativeSchema, scale-maxNativeSchema
+	}
+	count, _ := h.Count.(*typesv2.Histogram_CountInt)
+	if count == nil {
+		count = &typesv2.Histogram_CountInt{}
+	}
+	zeroCount, _ := h.ZeroCount.(*typesv2.Histogram_ZeroCountInt)
+	if zeroCount == nil {
+		zeroCount = &typesv2.Histogram_ZeroCountInt{}
+	}
+	count.CountInt, zeroCount.ZeroCountInt = p.Count(), p.ZeroCount()
+
+	*h = typesv2.Histogram{
+		Count:          count,
+		Sum:            p.Sum(),
+		Schema:         scale,
+		ZeroThreshold:  p.ZeroThreshold(),
+		ZeroCount:      zeroCount,
+		NegativeSpans:  h.NegativeSpans[:0],
+		NegativeDeltas: h.NegativeDeltas[:0],
+		PositiveSpans:  h.PositiveSpans[:0],
+		PositiveDeltas: h.PositiveDeltas[:0],
+		Timestamp:      p.Timestamp().AsTime().UnixMilli(),
+	}
+	if p.Flags().NoRecordedValue() {
+		h.Sum = math.Float64frombits(value.StaleNaN)
+	}
+	h.NegativeSpans, h.NegativeDeltas = appendBucketsLayout(h.NegativeSpans, h.NegativeDeltas, p.Negative(), scaleDown)
+	h.PositiveSpans, h.PositiveDeltas = appendBucketsLayout(h.PositiveSpans, h.PositiveDeltas, p.Positive(), scaleDown)
+	return dst
+}
+
+// appendBucketsLayout appends the spans and delta encoded counts of the buckets, merging
+// 2^scaleDown buckets into one. Empty buckets are left out, except for runs of at most two
+// between buckets, which are cheaper to encode as zero deltas than as a new span.
+func appendBucketsLayout(spans []typesv2.BucketSpan, deltas []int64, buckets pmetric.ExponentialHistogramDataPointBuckets, scaleDown int32) ([]typesv2.BucketSpan, []int64) {
+	counts := buckets.BucketCounts()
+	var (
+		prev  int64
+		next  int32
+		first = true
+	)
+	for i := 0; i < counts.Len(); {
+		// Shifting floors negative indexes as well.
+		idx := (buckets.Offset() + int32(i)) >> scaleDown
+		var count uint64
+		for ; i < counts.Len() && (buckets.Offset()+int32(i))>>scaleDown == idx; i++ {
+			count += counts.At(i)
+		}
+		if count == 0 {
+			continue
+		}
+		idx++
+
+		switch {
+		case first:
+			spans = append(spans, typesv2.BucketSpan{Offset: idx})
+			first = false
+		case idx-next > 2:
+			spans = append(spans, typesv2.BucketSpan{Offset: idx - next})
+		default:
+			for ; next < idx; next++ {
+				spans[len(spans)-1].Length++
+				deltas = append(deltas, -prev)
+				prev = 0
+			}
+		}
+		spans[len(spans)-1].Length++
+		deltas = append(deltas, int64(count)-prev)
+		prev, next = int64(count), idx+1
+	}
+	return spans, deltas
+}
+
+// customBucketsSchema is the schema of native histograms with custom buckets (NHCB), whose
+// bucket boundaries are the custom values of the histogram.
+const customBucketsSchema = -53
+
+// nativeToExponentialHistogram fills dp with the native histogram h. Native histogram schemas
+// are exponential histogram scales; bucket i of a native histogram covers (base^(i-1), base^i]
+// while OTLP bucket i covers (base^i, base^(i+1)], hence the offset by one.
+func nativeToExponentialHistogram(h typesv2.Histogram, dp pmetric.ExponentialHistogramDataPoint) error {
+	if h.Schema < -4 || h.Schema > 8 {
+		return fmt.Errorf("schema %d is out of the exponential schemas range [-4, 8]", h.Schema)
+	}
+	count, zeroCount := HistogramCounts(h)
+	dp.SetScale(h.Schema)
+	dp.SetCount(uint64(math.Round(count)))
+	dp.SetSum(h.Sum)
+	dp.SetZeroCount(uint64(math.Round(zeroCount)))
+	dp.SetZeroThreshold(h.ZeroThreshold)
+	dp.SetTimestamp(msToTimestamp(h.Timestamp))
+	if value.IsStaleNaN(h.Sum) {
+		dp.SetFlags(pmetric.DefaultDataPointFlags.WithNoRecordedValue(true))
+	}
+
+	for _, b := range []struct {
+		spans  []typesv2.BucketSpan
+		deltas []int64
+		counts []float64
+		dst    pmetric.ExponentialHistogramDataPointBuckets
+	}{
+		{h.PositiveSpans, h.PositiveDeltas, h.PositiveCounts, dp.Positive()},
+		{h.NegativeSpans, h.NegativeDeltas, h.NegativeCounts, dp.Negative()},
+	} {
+		first, buckets, err := expandBuckets(b.spans, b.deltas, b.counts)
+		if err != nil {
+			return err
+		}
+		if len(buckets) > 0 {
+			b.dst.SetOffset(first - 1)
+			b.dst.BucketCounts().FromRaw(buckets)
+		}
+	}
+	return nil
 }
+
+// customBucketsToExplicitHistogram fills dp with the native histogram with custom buckets h,
+// whose bucket i is the one bounded above by its i-th custom value, the last one by +Inf.
+func customBucketsToExplicitHistogram(h typesv2.Histogram, dp pmetric.HistogramDataPoint) error {
+	if len(h.NegativeSpans) > 0 {
+		return errors.New("custom buckets histogram with negative buckets")
+	}
+	first, buckets, err := expandBuckets(h.PositiveSpans, h.PositiveDeltas, h.PositiveCounts)
+	if err != nil {
+		return err
+	}
+	if first < 0 || int(first)+len(buckets) > len(h.CustomValues)+1 {
+		return fmt.Errorf("buckets [%d, %d) out of the %d custom buckets", first, int(first)+len(buckets), len(h.CustomValues)+1)
+	}
+	counts := make([]uint64, len(h.CustomValues)+1)
+	copy(counts[first:], buckets)
+
+	count, _ := HistogramCounts(h)
+	dp.SetCount(uint64(math.Round(count)))
+	dp.SetSum(h.Sum)
+	dp.SetTimestamp(msToTimestamp(h.Timestamp))
+	dp.ExplicitBounds().FromRaw(h.CustomValues)
+	dp.BucketCounts().FromRaw(counts)
+	if value.IsStaleNaN(h.Sum) {
+		dp.SetFlags(pmetric.DefaultDataPointFlags.WithNoRecordedValue(true))
+	}
+	return nil
+}
+
+// expandBuckets expands the spans of native histogram buckets into dense bucket counts,
+// starting at bucket index first. The counts of float histograms are rounded.
+func expandBuckets(spans []typesv2.BucketSpan, deltas []int64, counts []float64) (first int32, buckets []uint64, err error) {
+	first, floatBuckets, err := expandBucketCounts(spans, deltas, counts)
+	if err != nil {
+		return 0, nil, err
+	}
+	buckets = make([]uint64, 0, len(floatBuckets))
+	for _, count := range floatBuckets {
+		buckets = append(buckets, uint64(math.Round(count)))
+	}
+	return first, buckets, nil
+}
+
+// expandBucketCounts is expandBuckets without rounding. Integer histograms delta encode
+// their counts, float histograms do not.
+func expandBucketCounts(spans []typesv2.BucketSpan, deltas []int64, counts []float64) (first int32, buckets []float64, err error) {
+	if len(deltas) > 0 && len(counts) > 0 {
+		return 0, nil, errors.New("both integer and float bucket counts")
+	}
+	n := len(deltas) + len(counts)
+	total := 0
+	for _, span := range spans {
+		total += int(span.Length)
+	}
+	if total != n {
+		return 0, nil, fmt.Errorf("spans cover %d buckets but %d counts are given", total, n)
+	}
+
+	var idx int32
+	var intCount int64
+	k := 0
+	for i, span := range spans {
+		if i == 0 {
+			idx, first = span.Offset, span.Offset
+		} else if span.Offset < 0 {
+			return 0, nil, fmt.Errorf("negative offset %d of span %d", span.Offset, i)
+		} else {
+			idx += span.Offset
+		}
+		for int(idx-first) > len(buckets) {
+			buckets = append(buckets, 0)
+		}
+		for j := uint32(0); j < span.Length; j++ {
+			var count float64
+			if len(counts) > 0 {
+				count = counts[k]
+			} else {
+				intCount += deltas[k]
+				count = float64(intCount)
+			}
+			if count < 0 {
+				return 0, nil, fmt.Errorf("negative count %v of bucket %d", count, idx)
+			}
+			buckets = append(buckets, count)
+			idx++
+			k++
+		}
+	}
+	return first, buckets, nil
+}
+
+// HistogramCounts returns the count and the zero bucket count of a native histogram, whether
+// it has integer or float counts.
+func HistogramCounts(h typesv2.Histogram) (count, zeroCount float64) {
+	switch c := h.Count.(type) {
+	case *typesv2.Histogram_CountInt:
+		count = float64(c.CountInt)
+	case *typesv2.Histogram_CountFloat:
+		count = c.CountFloat
+	}
+	switch c := h.ZeroCount.(type) {
+	case *typesv2.Histogram_ZeroCountInt:
+		zeroCount = float64(c.ZeroCountInt)
+	case *typesv2.Histogram_ZeroCountFloat:
+		zeroCount = c.ZeroCountFloat
+	}
+	return count, zeroCount
+}
+
+func msToTimestamp(ms int64) pcommon.Timestamp {
+	return pcommon.Timestamp(ms * int64(time.Millisecond))
+}
+
 func generateAttributes(m pcommon.Map, prefix string, count int) {
 	for i := 1; i <= count; i++ {
 		m.PutStr(fmt.Sprintf("%v-name-%v", prefix, i), fmt.Sprintf("value-%v", i))
@@ -95,12 +529,12 @@ func PrepareDummyExportRequest() pmetricotlp.ExportRequest {
 	return request
 }
 
-func packSymbol(length, offset uint32) uint32 {
+func packSymbol(length, offset uint32) (uint32, error) {
 	// Ensure that length and offset fit within the required bits
 	if length > 0xFFF || offset > 0xFFFFF {
-		panic("length or offset exceeds bit limits")
+		return 0, fmt.Errorf("%w: length %d or offset %d exceeds bit limits", ErrSymbolOverflow, length, offset)
 	}
-	return (length << 20) | offset
+	return (length << 20) | offset, nil
 }
 
 func unpackSymbol(packed uint32) (length, offset uint32) {
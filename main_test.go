@@ -1,19 +1,32 @@
 package prometheusremotewritev2
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"strings"
 	"testing"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"prometheusrwexporter-demo/otlpgen"
+	"prometheusrwexporter-demo/rwtest"
+	typesv2 "prometheusrwexporter-demo/types"
 )
 
 
 func TestV2WriteRequestBuilder(t *testing.T) {
+	server := rwtest.NewServer()
+	defer server.Close()
+
 	// Create a dummy export request
 	exportReq := PrepareDummyExportRequest()
 
 	// Initialize a V2WriteRequestBuilder
-	builder, err := NewV2RequestBuilder(exportReq, "http-config")
+	builder, err := NewV2RequestBuilder(exportReq, httpClientConfig{Endpoint: server.URL})
 	if err != nil {
 		t.Fatal("unexpected error occurred", err)
 	}
@@ -31,18 +44,35 @@ func TestV2WriteRequestBuilder(t *testing.T) {
 	for _, ts := range v2Request.Timeseries {
 		assert.Equal(t, 1, len(ts.Histograms), "Each TimeSeries should contain exactly one histogram")
 		assert.Equal(t, 155, int(ts.Histograms[0].Sum), "The histogram sum should be 155")
-		assert.Equal(t, int32(7), ts.Histograms[0].Schema, "The histogram schema should be 7")
+		assert.Equal(t, int32(0), ts.Histograms[0].Schema, "The histogram schema should be the scale of the data point")
+		assert.Equal(t, &typesv2.Histogram_CountInt{CountInt: 50}, ts.Histograms[0].Count, "The histogram count should be 50")
 	}
 
 	// Check that the symbols table has been populated correctly
 	assert.NotEmpty(t, v2Request.Symbols, "The symbols table should not be empty")
 
-    // The following lines of code don't "do" anything
-    // Encode the request
-    builder.encoder.Encode()
-    // Send it to a HTTP URL.
-    builder.createHTTPClient()
-    builder.send()
+	// Encode the request
+	encoded, err := builder.encoder.Encode(&builder.request)
+	assert.NoError(t, err)
+	decoded, err := builder.encoder.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, len(v2Request.Timeseries), len(decoded.Timeseries))
+	// Send it to a HTTP URL.
+	builder.createHTTPClient()
+	assert.NoError(t, builder.send(context.Background()))
+	require.Len(t, server.Requests(), 1)
+	assert.Len(t, server.Requests()[0].Timeseries, expectedTimeSeriesCount)
+	for i := 1; i <= 5; i++ {
+		server.AssertHistogramSum(t, labels.FromStrings("__name__", fmt.Sprintf("histogram-%d", i), "demo-resource-name-1", "value-1"), 155)
+	}
+
+	// Recoverable failures are retried.
+	server.Reset()
+	server.Script(rwtest.Response{StatusCode: http.StatusTooManyRequests, RetryAfter: "0"}, rwtest.Response{StatusCode: http.StatusServiceUnavailable})
+	builder.httpClientConfig.Retry = testRetryConfig()
+	assert.NoError(t, builder.send(context.Background()))
+	assert.Len(t, server.Received(), 3)
+	assert.Len(t, server.Requests(), 1)
 }
 
 func TestBuildLabelsUsingLabelRef(t *testing.T) {
@@ -50,8 +80,10 @@ func TestBuildLabelsUsingLabelRef(t *testing.T) {
 	symbolsTable := []string{"", "name", "prometheus"}
 	symbols := strings.Join(symbolsTable, "")
 
-	labelNameRef := packSymbol(4, 0)
-	labelValueRef := packSymbol(10, 4)
+	labelNameRef, err := packSymbol(4, 0)
+	assert.NoError(t, err)
+	labelValueRef, err := packSymbol(10, 4)
+	assert.NoError(t, err)
 	labelRefs = append(labelRefs, labelNameRef, labelValueRef)
 
 	labels := buildLabelsFromLabelRef(symbols, labelRefs)
@@ -59,3 +91,212 @@ func TestBuildLabelsUsingLabelRef(t *testing.T) {
 	assert.Equal(t, labels, expectedLabels, "The labels should match the expected name-value pairs.")
 
 }
+
+func TestV2WriteRequestBuilderIsReusable(t *testing.T) {
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+	assert.NoError(t, err)
+
+	// Add can be called any number of times before building.
+	builder.Add(PrepareDummyExportRequest().Metrics())
+	builder.Add(PrepareDummyExportRequest().Metrics())
+	req, err := builder.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(req.Timeseries))
+
+	builder.Reset()
+	req, err = builder.Build()
+	assert.NoError(t, err)
+	assert.Empty(t, req.Timeseries, "Reset should drop everything added before")
+
+	// A metric we can't convert doesn't prevent the others from being built.
+	md := PrepareDummyExportRequest().Metrics()
+	gauge := md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().AppendEmpty()
+	gauge.SetName("unsupported-gauge")
+	gauge.SetEmptyGauge()
+	builder.Add(md)
+	req, err = builder.Build()
+	assert.ErrorContains(t, err, "unsupported-gauge")
+	assert.Equal(t, 5, len(req.Timeseries))
+}
+
+func TestPackSymbolOverflow(t *testing.T) {
+	_, err := packSymbol(0x1000, 0)
+	assert.ErrorIs(t, err, ErrSymbolOverflow, "a 4KB label value must not crash us")
+	_, err = packSymbol(1, 0x100000)
+	assert.ErrorIs(t, err, ErrSymbolOverflow)
+}
+
+func TestLabelLengthLimits(t *testing.T) {
+	md := PrepareDummyExportRequest().Metrics()
+	md.ResourceMetrics().At(0).Resource().Attributes().PutStr("long", strings.Repeat("ü", 10))
+
+	limits := RequestLimits{MaxLabelValueLength: 9}
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{Limits: limits})
+	assert.NoError(t, err)
+	builder.Add(md)
+	req, err := builder.Build()
+	assert.NoError(t, err)
+	assert.Contains(t, req.Symbols, strings.Repeat("ü", 4), "the value should be cut at a rune boundary")
+
+	limits.LabelLimitAction = LabelLimitDrop
+	builder, err = NewV2WriteRequestBuilder(httpClientConfig{Limits: limits})
+	assert.NoError(t, err)
+	builder.Add(md)
+	req, err = builder.Build()
+	assert.Empty(t, req.Timeseries)
+	assert.Equal(t, map[DropReason]int{ReasonLabelTooLong: 5}, DroppedPoints(err))
+}
+
+func TestV2WriteRequestBuilderSteadyStateAllocs(t *testing.T) {
+	md := generateWorkload(t, 1)
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+	require.NoError(t, err)
+	builder.Add(md)
+	_, err = builder.Build()
+	require.NoError(t, err)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		builder.Reset()
+		builder.Add(md)
+		_, _ = builder.Build()
+	})
+	assert.Zero(t, allocs, "a warmed up builder should reuse the memory of the previous builds")
+}
+
+func TestV2WriteRequestBuilderReuseMatchesFreshBuild(t *testing.T) {
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+	require.NoError(t, err)
+	builder.Add(generateWorkload(t, 2))
+	_, err = builder.Build()
+	require.NoError(t, err)
+
+	// A smaller batch must not pick up anything of the larger one before.
+	md := generateWorkload(t, 0)
+	builder.Reset()
+	builder.Add(md)
+	reused, err := builder.Build()
+	require.NoError(t, err)
+	fresh, err := RequestFromMetrics(md, RequestLimits{})
+	require.NoError(t, err)
+
+	diffs, err := DiffRequests(fresh, reused)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+	assert.Len(t, reused.Symbols, len(fresh.Symbols))
+}
+
+func TestNativeHistogramConversion(t *testing.T) {
+	dp := pmetric.NewExponentialHistogramDataPoint()
+	dp.SetScale(2)
+	dp.SetCount(16)
+	dp.SetSum(42)
+	dp.SetZeroCount(1)
+	dp.SetZeroThreshold(1e-9)
+	dp.Positive().SetOffset(-2)
+	// A gap of two buckets is filled with zeroes, one of three starts a new span.
+	dp.Positive().BucketCounts().FromRaw([]uint64{0, 1, 0, 0, 2, 3, 0, 0, 0, 4})
+	dp.Negative().SetOffset(3)
+	dp.Negative().BucketCounts().FromRaw([]uint64{5})
+
+	histograms := appendNativeHistogram(nil, dp)
+	require.Len(t, histograms, 1)
+	h := histograms[0]
+	assert.Equal(t, int32(2), h.Schema)
+	assert.Equal(t, &typesv2.Histogram_CountInt{CountInt: 16}, h.Count)
+	assert.Equal(t, &typesv2.Histogram_ZeroCountInt{ZeroCountInt: 1}, h.ZeroCount)
+	assert.Equal(t, []typesv2.BucketSpan{{Offset: 0, Length: 5}, {Offset: 3, Length: 1}}, h.PositiveSpans)
+	assert.Equal(t, []int64{1, -1, 0, 2, 1, 1}, h.PositiveDeltas)
+	assert.Equal(t, []typesv2.BucketSpan{{Offset: 4, Length: 1}}, h.NegativeSpans)
+	assert.Equal(t, []int64{5}, h.NegativeDeltas)
+
+	back := pmetric.NewExponentialHistogramDataPoint()
+	require.NoError(t, nativeToExponentialHistogram(h, back))
+	assert.Equal(t, int32(-1), back.Positive().Offset())
+	assert.Equal(t, []uint64{1, 0, 0, 2, 3, 0, 0, 0, 4}, back.Positive().BucketCounts().AsRaw())
+	assert.Equal(t, int32(3), back.Negative().Offset())
+	assert.Equal(t, []uint64{5}, back.Negative().BucketCounts().AsRaw())
+	assert.Equal(t, dp.Count(), back.Count())
+
+	// Scales finer than 8 are merged into the buckets of scale 8.
+	dp.SetScale(10)
+	h = appendNativeHistogram(histograms[:0], dp)[0]
+	assert.Equal(t, int32(8), h.Schema)
+	assert.Equal(t, []typesv2.BucketSpan{{Offset: 0, Length: 3}}, h.PositiveSpans)
+	assert.Equal(t, []int64{1, 4, -1}, h.PositiveDeltas)
+	assert.Equal(t, []typesv2.BucketSpan{{Offset: 1, Length: 1}}, h.NegativeSpans)
+}
+
+func TestBuildGroupsDataPointsIntoSeries(t *testing.T) {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("job", "api")
+	metric := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	metric.SetName("latency")
+	metric.SetEmptyExponentialHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	// The points of two series come interleaved, the attributes of one in any order.
+	for i, path := range []string{"/a", "/b", "/a", "/b"} {
+		dp := metric.ExponentialHistogram().DataPoints().AppendEmpty()
+		if i < 2 {
+			dp.Attributes().PutStr("path", path)
+			dp.Attributes().PutStr("method", "GET")
+		} else {
+			dp.Attributes().PutStr("method", "GET")
+			dp.Attributes().PutStr("path", path)
+		}
+		dp.SetStartTimestamp(pcommon.Timestamp(i+1) * 1e6)
+		dp.SetTimestamp(pcommon.Timestamp(i+10) * 1e6)
+		dp.SetCount(uint64(i))
+	}
+
+	req, err := RequestFromMetrics(md, RequestLimits{})
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 2)
+	for i, path := range []string{"/a", "/b"} {
+		series := req.Timeseries[i]
+		var lbls []string
+		for j := 0; j < len(series.LabelsRefs); j += 2 {
+			lbls = append(lbls, req.Symbols[series.LabelsRefs[j]]+"="+req.Symbols[series.LabelsRefs[j+1]])
+		}
+		assert.Equal(t, []string{"__name__=latency", "job=api", "method=GET", "path=" + path}, lbls)
+		require.Len(t, series.Histograms, 2)
+		assert.Equal(t, []int64{int64(i + 10), int64(i + 12)}, []int64{series.Histograms[0].Timestamp, series.Histograms[1].Timestamp})
+		assert.Equal(t, int64(i+1), series.CreatedTimestamp, "the start of the first point of the series")
+	}
+
+	// So do the series generated by otlpgen.
+	cfg := otlpgen.DefaultConfig()
+	cfg.Resources, cfg.SeriesPerMetric, cfg.DataPointsPerSeries = 1, 10, 2
+	cfg.Gauges, cfg.Sums, cfg.Histograms, cfg.Summaries, cfg.ExponentialHistograms = 0, 0, 0, 0, 1
+	md, err = otlpgen.Generate(cfg)
+	require.NoError(t, err)
+	req, err = RequestFromMetrics(md, RequestLimits{})
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 10)
+	seen := map[string]bool{}
+	for _, series := range req.Timeseries {
+		assert.Len(t, series.Histograms, 2)
+		for j := 0; j < len(series.LabelsRefs); j += 2 {
+			if req.Symbols[series.LabelsRefs[j]] == "series" {
+				seen[req.Symbols[series.LabelsRefs[j+1]]] = true
+			}
+		}
+	}
+	assert.Len(t, seen, 10)
+}
+
+func TestBuildSetsMetricType(t *testing.T) {
+	md := pmetric.NewMetrics()
+	metrics := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics()
+	for _, temporality := range []pmetric.AggregationTemporality{pmetric.AggregationTemporalityCumulative, pmetric.AggregationTemporalityDelta} {
+		metric := metrics.AppendEmpty()
+		metric.SetName(strings.ToLower(temporality.String()))
+		metric.SetEmptyExponentialHistogram().SetAggregationTemporality(temporality)
+		metric.ExponentialHistogram().DataPoints().AppendEmpty().SetCount(1)
+	}
+
+	req, err := RequestFromMetrics(md, RequestLimits{})
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 2)
+	assert.Equal(t, typesv2.Metadata_METRIC_TYPE_HISTOGRAM, req.Timeseries[0].Metadata.Type)
+	assert.Equal(t, typesv2.Metadata_METRIC_TYPE_GAUGEHISTOGRAM, req.Timeseries[1].Metadata.Type)
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package prometheusremotewritev2
+
+const raceEnabled = false
@@ -0,0 +1,343 @@
+// Package otlpgen generates synthetic OTLP metrics of a configurable shape, to model real
+// traffic in tests, benchmarks and on the command line.
+package otlpgen
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+// Config describes the metrics to generate. Every resource has the same scopes, every scope
+// the same metrics, and every metric the same number of series.
+type Config struct {
+	Resources          int
+	ScopesPerResource  int
+	ResourceAttributes int
+
+	// Metrics per scope, by type.
+	Gauges                int
+	Sums                  int
+	Histograms            int
+	ExponentialHistograms int
+	Summaries             int
+
+	// SeriesPerMetric is the number of data point attribute sets of every metric.
+	SeriesPerMetric int
+	// Attributes is the number of attributes of a series. The first one tells the series of
+	// a metric apart, the others take AttributeCardinality distinct values each.
+	Attributes           int
+	AttributeCardinality int
+	// LabelValueLength pads attribute values to at least this many bytes.
+	LabelValueLength int
+
+	// DataPointsPerSeries is the number of points of every series in a batch, Interval apart.
+	DataPointsPerSeries int
+	Interval            time.Duration
+	// Temporality of the sums and histograms.
+	Temporality pmetric.AggregationTemporality
+	// ChurnRate is the fraction of the series of every metric replaced by new ones from one
+	// batch to the next.
+	ChurnRate float64
+
+	// Start is the timestamp of the first point, Seed makes the values reproducible.
+	Start time.Time
+	Seed  int64
+}
+
+// DefaultConfig is a small workload of every metric type.
+func DefaultConfig() Config {
+	return Config{
+		Resources:             1,
+		ScopesPerResource:     1,
+		ResourceAttributes:    5,
+		Gauges:                2,
+		Sums:                  2,
+		Histograms:            1,
+		ExponentialHistograms: 1,
+		Summaries:             1,
+		SeriesPerMetric:       10,
+		Attributes:            3,
+		AttributeCardinality:  5,
+		LabelValueLength:      0,
+		DataPointsPerSeries:   1,
+		Interval:              15 * time.Second,
+		Temporality:           pmetric.AggregationTemporalityCumulative,
+		Start:                 time.Unix(1700000000, 0),
+		Seed:                  1,
+	}
+}
+
+func (cfg *Config) Validate() error {
+	for name, v := range map[string]int{
+		"resources":              cfg.Resources,
+		"scopes per resource":    cfg.ScopesPerResource,
+		"resource attributes":    cfg.ResourceAttributes,
+		"gauges":                 cfg.Gauges,
+		"sums":                   cfg.Sums,
+		"histograms":             cfg.Histograms,
+		"exponential histograms": cfg.ExponentialHistograms,
+		"summaries":              cfg.Summaries,
+		"series per metric":      cfg.SeriesPerMetric,
+		"attributes":             cfg.Attributes,
+		"label value length":     cfg.LabelValueLength,
+		"data points per series": cfg.DataPointsPerSeries,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if cfg.SeriesPerMetric > 1 && cfg.Attributes == 0 {
+		return errors.New("more than one series per metric needs at least one attribute")
+	}
+	if cfg.Attributes > 1 && cfg.AttributeCardinality < 1 {
+		return errors.New("attribute cardinality must be positive")
+	}
+	if cfg.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if cfg.Temporality != pmetric.AggregationTemporalityCumulative && cfg.Temporality != pmetric.AggregationTemporalityDelta {
+		return fmt.Errorf("unsupported temporality %v", cfg.Temporality)
+	}
+	if cfg.ChurnRate < 0 || cfg.ChurnRate > 1 {
+		return errors.New("churn rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// Generator generates successive batches of the workload of its config.
+type Generator struct {
+	cfg Config
+	rnd *rand.Rand
+	// series holds the ids of the live series, shared by every metric.
+	series []int
+	nextID int
+	// batch is the number of batches generated so far.
+	batch int
+}
+
+func New(cfg Config) (*Generator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	g := &Generator{cfg: cfg, rnd: rand.New(rand.NewSource(cfg.Seed))}
+	for ; g.nextID < cfg.SeriesPerMetric; g.nextID++ {
+		g.series = append(g.series, g.nextID)
+	}
+	return g, nil
+}
+
+// Generate returns a single batch of the workload of cfg.
+func Generate(cfg Config) (pmetric.Metrics, error) {
+	g, err := New(cfg)
+	if err != nil {
+		return pmetric.Metrics{}, err
+	}
+	return g.Next(), nil
+}
+
+// Next returns the next batch, DataPointsPerSeries points per series later than the
+// previous one, after replacing the churned series.
+func (g *Generator) Next() pmetric.Metrics {
+	if g.batch > 0 {
+		g.churn()
+	}
+	md := pmetric.NewMetrics()
+	for r := 0; r < g.cfg.Resources; r++ {
+		rm := md.ResourceMetrics().AppendEmpty()
+		attrs := rm.Resource().Attributes()
+		attrs.PutStr("service.name", fmt.Sprintf("service-%d", r))
+		for i := 0; i < g.cfg.ResourceAttributes; i++ {
+			attrs.PutStr(fmt.Sprintf("resource.attr-%d", i), g.value(fmt.Sprintf("resource-%d-%d", r, i)))
+		}
+		for s := 0; s < g.cfg.ScopesPerResource; s++ {
+			sm := rm.ScopeMetrics().AppendEmpty()
+			sm.Scope().SetName(fmt.Sprintf("otlpgen/scope-%d", s))
+			g.appendMetrics(sm.Metrics(), s)
+		}
+	}
+	g.batch++
+	return md
+}
+
+// churn replaces the oldest series by new ones.
+func (g *Generator) churn() {
+	n := int(math.Round(g.cfg.ChurnRate * float64(len(g.series))))
+	for i := 0; i < n; i++ {
+		g.series = append(g.series[1:], g.nextID)
+		g.nextID++
+	}
+}
+
+func (g *Generator) appendMetrics(metrics pmetric.MetricSlice, scope int) {
+	for _, kind := range []struct {
+		name  string
+		count int
+		fill  func(m pmetric.Metric)
+	}{
+		{"gauge", g.cfg.Gauges, g.fillGauge},
+		{"sum", g.cfg.Sums, g.fillSum},
+		{"histogram", g.cfg.Histograms, g.fillHistogram},
+		{"exponential_histogram", g.cfg.ExponentialHistograms, g.fillExponentialHistogram},
+		{"summary", g.cfg.Summaries, g.fillSummary},
+	} {
+		for i := 0; i < kind.count; i++ {
+			m := metrics.AppendEmpty()
+			m.SetName(fmt.Sprintf("otlpgen_%s_%d_%d", kind.name, scope, i))
+			m.SetDescription(fmt.Sprintf("Generated %s.", strings.ReplaceAll(kind.name, "_", " ")))
+			m.SetUnit("1")
+			kind.fill(m)
+		}
+	}
+}
+
+// points calls fill for every point of every series, with the series attributes to set, the
+// id of the series and the number of steps since the generator started, 1 for the first
+// point.
+func (g *Generator) points(fill func(attrs pcommon.Map, start, ts pcommon.Timestamp, id, step int)) {
+	attrs := pcommon.NewMap()
+	for _, id := range g.series {
+		attrs.Clear()
+		g.seriesAttributes(id, attrs)
+		for p := 0; p < g.cfg.DataPointsPerSeries; p++ {
+			step := g.batch*g.cfg.DataPointsPerSeries + p
+			ts := g.cfg.Start.Add(time.Duration(step) * g.cfg.Interval)
+			start := g.cfg.Start
+			if g.cfg.Temporality == pmetric.AggregationTemporalityDelta {
+				start = ts.Add(-g.cfg.Interval)
+			}
+			fill(attrs, pcommon.NewTimestampFromTime(start), pcommon.NewTimestampFromTime(ts), id, step+1)
+		}
+	}
+}
+
+func (g *Generator) seriesAttributes(id int, attrs pcommon.Map) {
+	attrs.EnsureCapacity(g.cfg.Attributes)
+	for i := 0; i < g.cfg.Attributes; i++ {
+		if i == 0 {
+			attrs.PutStr("series", g.value(fmt.Sprintf("series-%d", id)))
+			continue
+		}
+		attrs.PutStr(fmt.Sprintf("attr-%d", i), g.value(fmt.Sprintf("value-%d", (id+i)%g.cfg.AttributeCardinality)))
+	}
+}
+
+// value pads v to LabelValueLength.
+func (g *Generator) value(v string) string {
+	if len(v) >= g.cfg.LabelValueLength {
+		return v
+	}
+	return v + strings.Repeat("x", g.cfg.LabelValueLength-len(v))
+}
+
+// counter is the value after step steps of a counter growing by rate every step, so that
+// cumulative series are monotonic. Delta series report the growth of a single step.
+func (g *Generator) counter(rate, step int) uint64 {
+	if g.cfg.Temporality == pmetric.AggregationTemporalityDelta {
+		return uint64(rate)
+	}
+	return uint64(rate * step)
+}
+
+func (g *Generator) fillGauge(m pmetric.Metric) {
+	dps := m.SetEmptyGauge().DataPoints()
+	g.points(func(attrs pcommon.Map, _, ts pcommon.Timestamp, _, _ int) {
+		dp := dps.AppendEmpty()
+		attrs.CopyTo(dp.Attributes())
+		dp.SetTimestamp(ts)
+		dp.SetDoubleValue(math.Round(g.rnd.Float64()*10000) / 100)
+	})
+}
+
+func (g *Generator) fillSum(m pmetric.Metric) {
+	sum := m.SetEmptySum()
+	sum.SetIsMonotonic(true)
+	sum.SetAggregationTemporality(g.cfg.Temporality)
+	dps := sum.DataPoints()
+	g.points(func(attrs pcommon.Map, start, ts pcommon.Timestamp, id, step int) {
+		dp := dps.AppendEmpty()
+		attrs.CopyTo(dp.Attributes())
+		dp.SetStartTimestamp(start)
+		dp.SetTimestamp(ts)
+		dp.SetDoubleValue(float64(g.counter(1+id%10, step)))
+	})
+}
+
+var histogramBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (g *Generator) fillHistogram(m pmetric.Metric) {
+	h := m.SetEmptyHistogram()
+	h.SetAggregationTemporality(g.cfg.Temporality)
+	dps := h.DataPoints()
+	g.points(func(attrs pcommon.Map, start, ts pcommon.Timestamp, id, step int) {
+		dp := dps.AppendEmpty()
+		attrs.CopyTo(dp.Attributes())
+		dp.SetStartTimestamp(start)
+		dp.SetTimestamp(ts)
+		dp.ExplicitBounds().FromRaw(histogramBounds)
+		counts := make([]uint64, len(histogramBounds)+1)
+		var count uint64
+		var sum float64
+		for i := range counts {
+			counts[i] = g.counter((id+i)%5, step)
+			count += counts[i]
+			if i < len(histogramBounds) {
+				sum += float64(counts[i]) * histogramBounds[i]
+			}
+		}
+		dp.BucketCounts().FromRaw(counts)
+		dp.SetCount(count)
+		dp.SetSum(sum)
+	})
+}
+
+func (g *Generator) fillExponentialHistogram(m pmetric.Metric) {
+	h := m.SetEmptyExponentialHistogram()
+	h.SetAggregationTemporality(g.cfg.Temporality)
+	dps := h.DataPoints()
+	g.points(func(attrs pcommon.Map, start, ts pcommon.Timestamp, id, step int) {
+		dp := dps.AppendEmpty()
+		attrs.CopyTo(dp.Attributes())
+		dp.SetStartTimestamp(start)
+		dp.SetTimestamp(ts)
+		dp.SetScale(2)
+		dp.SetZeroCount(g.counter(id%3, step))
+		// 12 buckets of scale 2 around 1, (2^(-2/4), 2^(10/4)].
+		dp.Positive().SetOffset(-2)
+		counts := make([]uint64, 12)
+		count := dp.ZeroCount()
+		var sum float64
+		for i := range counts {
+			counts[i] = g.counter((id+i)%5, step)
+			count += counts[i]
+			sum += float64(counts[i]) * math.Exp2(float64(i-1)/4)
+		}
+		dp.Positive().BucketCounts().FromRaw(counts)
+		dp.SetCount(count)
+		dp.SetSum(sum)
+	})
+}
+
+func (g *Generator) fillSummary(m pmetric.Metric) {
+	dps := m.SetEmptySummary().DataPoints()
+	g.points(func(attrs pcommon.Map, start, ts pcommon.Timestamp, id, step int) {
+		dp := dps.AppendEmpty()
+		attrs.CopyTo(dp.Attributes())
+		dp.SetStartTimestamp(start)
+		dp.SetTimestamp(ts)
+		count := g.counter(10+id%10, step)
+		dp.SetCount(count)
+		dp.SetSum(float64(count) * 0.42)
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			qv := dp.QuantileValues().AppendEmpty()
+			qv.SetQuantile(q)
+			qv.SetValue(q * float64(1+g.rnd.Intn(100)))
+		}
+	})
+}
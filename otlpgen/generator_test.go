@@ -0,0 +1,142 @@
+package otlpgen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+// seriesOf returns the "series" attribute of every point of the first metric.
+func seriesOf(md pmetric.Metrics) []string {
+	var series []string
+	dps := md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Gauge().DataPoints()
+	for i := 0; i < dps.Len(); i++ {
+		v, _ := dps.At(i).Attributes().Get("series")
+		series = append(series, v.Str())
+	}
+	return series
+}
+
+func TestGenerateShape(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Resources = 3
+	cfg.ScopesPerResource = 2
+	cfg.DataPointsPerSeries = 4
+	md, err := Generate(cfg)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, md.ResourceMetrics().Len())
+	assert.Equal(t, 3*2*7, md.MetricCount())
+	assert.Equal(t, 3*2*7*10*4, md.DataPointCount())
+
+	rm := md.ResourceMetrics().At(1)
+	assert.Equal(t, 6, rm.Resource().Attributes().Len())
+	metrics := rm.ScopeMetrics().At(1).Metrics()
+	types := map[pmetric.MetricType]int{}
+	for i := 0; i < metrics.Len(); i++ {
+		types[metrics.At(i).Type()]++
+	}
+	assert.Equal(t, map[pmetric.MetricType]int{
+		pmetric.MetricTypeGauge:                2,
+		pmetric.MetricTypeSum:                  2,
+		pmetric.MetricTypeHistogram:            1,
+		pmetric.MetricTypeExponentialHistogram: 1,
+		pmetric.MetricTypeSummary:              1,
+	}, types)
+}
+
+func TestGenerateAttributes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SeriesPerMetric = 20
+	cfg.Attributes = 3
+	cfg.AttributeCardinality = 4
+	cfg.LabelValueLength = 32
+	md, err := Generate(cfg)
+	require.NoError(t, err)
+
+	dps := md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Gauge().DataPoints()
+	require.Equal(t, 20, dps.Len())
+	values := map[string]map[string]bool{}
+	for i := 0; i < dps.Len(); i++ {
+		attrs := dps.At(i).Attributes()
+		assert.Equal(t, 3, attrs.Len())
+		attrs.Range(func(k string, v pcommon.Value) bool {
+			assert.Len(t, v.Str(), 32)
+			if values[k] == nil {
+				values[k] = map[string]bool{}
+			}
+			values[k][v.Str()] = true
+			return true
+		})
+	}
+	assert.Len(t, values["series"], 20)
+	assert.Len(t, values["attr-1"], 4)
+	assert.Len(t, values["attr-2"], 4)
+}
+
+func TestGeneratorChurn(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ChurnRate = 0.3
+	gen, err := New(cfg)
+	require.NoError(t, err)
+
+	first, second := seriesOf(gen.Next()), seriesOf(gen.Next())
+	assert.Equal(t, first[3:], second[:7])
+	assert.Equal(t, []string{"series-10", "series-11", "series-12"}, second[7:])
+}
+
+func TestGeneratorCumulativeIsMonotonic(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Sums, cfg.Gauges = 1, 0
+	gen, err := New(cfg)
+	require.NoError(t, err)
+
+	sum := func(md pmetric.Metrics) pmetric.NumberDataPoint {
+		return md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Sum().DataPoints().At(0)
+	}
+	first, second := sum(gen.Next()), sum(gen.Next())
+	assert.Greater(t, second.DoubleValue(), first.DoubleValue())
+	assert.Equal(t, first.StartTimestamp(), second.StartTimestamp())
+	assert.Equal(t, pcommon.Timestamp(cfg.Interval.Nanoseconds()), second.Timestamp()-first.Timestamp())
+}
+
+func TestGeneratorDelta(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Temporality = pmetric.AggregationTemporalityDelta
+	md, err := Generate(cfg)
+	require.NoError(t, err)
+
+	h := md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(4).Histogram()
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, h.AggregationTemporality())
+	dp := h.DataPoints().At(0)
+	assert.Equal(t, pcommon.Timestamp(cfg.Interval.Nanoseconds()), dp.Timestamp()-dp.StartTimestamp())
+}
+
+func TestGenerateIsReproducible(t *testing.T) {
+	a, err := Generate(DefaultConfig())
+	require.NoError(t, err)
+	b, err := Generate(DefaultConfig())
+	require.NoError(t, err)
+	assert.Equal(t, a, b)
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"negative count":       func(cfg *Config) { cfg.Gauges = -1 },
+		"series without attrs": func(cfg *Config) { cfg.Attributes = 0 },
+		"zero cardinality":     func(cfg *Config) { cfg.AttributeCardinality = 0 },
+		"zero interval":        func(cfg *Config) { cfg.Interval = 0 },
+		"unset temporality":    func(cfg *Config) { cfg.Temporality = pmetric.AggregationTemporalityUnspecified },
+		"churn above 1":        func(cfg *Config) { cfg.ChurnRate = 1.5 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			mutate(&cfg)
+			_, err := New(cfg)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,610 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+const (
+	ewmaWeight = 0.2
+	// shardToleranceFraction is how far the desired number of shards may drift from the
+	// current one before we bother resharding.
+	shardToleranceFraction = 0.3
+	// backlogGain is the share of the pending backlog we try to catch up on per update period.
+	backlogGain = 0.1
+)
+
+var errQueueStopped = errors.New("queue manager is not running")
+
+// QueueConfig configures the sharded queue that sends series to the remote endpoint. The
+// settings follow Prometheus' queue_config.
+type QueueConfig struct {
+	// Capacity is the number of series each shard buffers before Append blocks.
+	Capacity  int `mapstructure:"capacity"`
+	MinShards int `mapstructure:"min_shards"`
+	MaxShards int `mapstructure:"max_shards"`
+	// MaxSamplesPerSend is the number of samples and histograms after which a shard sends
+	// the series it has buffered.
+	MaxSamplesPerSend int `mapstructure:"max_samples_per_send"`
+	// MaxBytesPerSend, when positive, is the size in bytes after which a shard sends the
+	// series it has buffered, so that the series of many small export requests share the
+	// symbols table of a few large requests. Labels count with their full strings, before the
+	// symbols table deduplicates them.
+	MaxBytesPerSend int `mapstructure:"max_bytes_per_send"`
+	// BatchSendDeadline is the longest a series waits in a shard before being sent.
+	BatchSendDeadline time.Duration `mapstructure:"batch_send_deadline"`
+	// ShardUpdateDuration is how often the number of shards is reconsidered.
+	ShardUpdateDuration time.Duration `mapstructure:"shard_update_duration"`
+	// PersistentQueue, when it has a directory, makes the shards write their requests to
+	// disk, from where they are sent oldest first. Requests survive restarts and outages of
+	// the remote endpoint at the cost of being sent one at a time.
+	PersistentQueue DiskQueueConfig `mapstructure:"persistent_queue"`
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Capacity:            10000,
+		MinShards:           1,
+		MaxShards:           50,
+		MaxSamplesPerSend:   2000,
+		BatchSendDeadline:   5 * time.Second,
+		ShardUpdateDuration: 10 * time.Second,
+	}
+}
+
+func (cfg QueueConfig) Validate() error {
+	if cfg.Capacity <= 0 {
+		return errors.New("queue: capacity must be positive")
+	}
+	if cfg.MinShards <= 0 || cfg.MaxShards < cfg.MinShards {
+		return errors.New("queue: shards must satisfy 0 < min_shards <= max_shards")
+	}
+	if cfg.MaxSamplesPerSend <= 0 {
+		return errors.New("queue: max samples per send must be positive")
+	}
+	if cfg.MaxBytesPerSend < 0 {
+		return errors.New("queue: max bytes per send must not be negative")
+	}
+	if cfg.BatchSendDeadline <= 0 || cfg.ShardUpdateDuration <= 0 {
+		return errors.New("queue: batch send deadline and shard update duration must be positive")
+	}
+	return cfg.PersistentQueue.Validate()
+}
+
+// pendingSeries is a series whose labels have not been turned into references yet, so that
+// every shard can build the symbols table of its own requests.
+type pendingSeries struct {
+	labels []prompb.Label
+	series typesv2.TimeSeries
+	// buffers, if set, backs the labels and histograms. It is put back in seriesBuffersPool
+	// once the series was sent.
+	buffers *seriesBuffers
+}
+
+// seriesBuffers holds the labels and histograms of a queued series, which go back and forth
+// between the builders and the shards instead of being allocated for every series.
+type seriesBuffers struct {
+	labels     []prompb.Label
+	histograms []typesv2.Histogram
+}
+
+var seriesBuffersPool = sync.Pool{New: func() any { return new(seriesBuffers) }}
+
+// release hands the buffers of the series back to the builders.
+func (s pendingSeries) release() {
+	if s.buffers != nil {
+		seriesBuffersPool.Put(s.buffers)
+	}
+}
+
+func (s pendingSeries) size() int {
+	return len(s.series.Samples) + len(s.series.Histograms)
+}
+
+// bytes estimates how much the series adds to a request.
+func (s pendingSeries) bytes() int {
+	n := s.series.Size()
+	for _, l := range s.labels {
+		n += len(l.Name) + len(l.Value)
+	}
+	return n
+}
+
+// QueueManager fans series out to a dynamic number of shards, each sending its own requests.
+// Series are assigned to shards by a hash of their label set, so the samples of a series
+// are always sent in the order they were appended.
+type QueueManager struct {
+	cfg       QueueConfig
+	clientCfg httpClientConfig
+	client    *http.Client
+	encoder   encoder
+	diskQueue *DiskQueue
+	logger    *zap.Logger
+
+	shardsMtx sync.RWMutex
+	shards    []*shard
+	numShards int
+	// resharding is closed before the shards are replaced, to wake up the Append calls
+	// waiting for room in a full shard with the lock held.
+	resharding chan struct{}
+
+	dataIn          *ewmaRate
+	dataOut         *ewmaRate
+	dataOutDuration *ewmaRate
+	pending         atomic.Int64
+
+	seriesSent   atomic.Int64
+	seriesFailed atomic.Int64
+	// requestsEvicted counts the requests the persistent queue dropped before sending them.
+	requestsEvicted atomic.Int64
+	// symbolBytesSaved is what compacting the symbols tables saved.
+	symbolBytesSaved atomic.Int64
+
+	errMtx  sync.Mutex
+	lastErr error
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewQueueManager(cfg QueueConfig, clientCfg httpClientConfig, logger *zap.Logger) (*QueueManager, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := clientCfg.Retry.Validate(); err != nil {
+		return nil, err
+	}
+	var diskQueue *DiskQueue
+	if cfg.PersistentQueue.Directory != "" {
+		var err error
+		if diskQueue, err = OpenDiskQueue(cfg.PersistentQueue); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &QueueManager{
+		cfg:             cfg,
+		clientCfg:       clientCfg,
+		client:          &http.Client{Timeout: clientCfg.Timeout},
+		encoder:         snappyEncoder{},
+		diskQueue:       diskQueue,
+		logger:          logger,
+		numShards:       cfg.MinShards,
+		dataIn:          newEWMARate(ewmaWeight, cfg.ShardUpdateDuration),
+		dataOut:         newEWMARate(ewmaWeight, cfg.ShardUpdateDuration),
+		dataOutDuration: newEWMARate(ewmaWeight, cfg.ShardUpdateDuration),
+		ctx:             ctx,
+		cancel:          cancel,
+		quit:            make(chan struct{}),
+		resharding:      make(chan struct{}),
+	}, nil
+}
+
+// Start spins up the shards and the loop that resizes them.
+func (qm *QueueManager) Start() {
+	qm.shardsMtx.Lock()
+	qm.startShards(qm.numShards)
+	qm.shardsMtx.Unlock()
+
+	qm.wg.Add(1)
+	go qm.updateShardsLoop()
+
+	if qm.diskQueue != nil {
+		qm.wg.Add(1)
+		go qm.runDiskSender()
+	}
+}
+
+// Stop flushes whatever is buffered and waits until it has been sent. With a persistent
+// queue, buffered series are only written to disk, and the request being sent from disk is
+// abandoned to be sent after the next start. Stopping twice does nothing.
+//
+// Once ctx is done, the requests being sent are abandoned, retries included, and the
+// series left are counted as failed; Stop then returns the error of ctx.
+func (qm *QueueManager) Stop(ctx context.Context) error {
+	var err error
+	qm.stopOnce.Do(func() {
+		close(qm.quit)
+
+		flushed := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				qm.cancel()
+			case <-flushed:
+			}
+		}()
+		qm.shardsMtx.Lock()
+		qm.stopShards()
+		qm.shardsMtx.Unlock()
+		close(flushed)
+		err = ctx.Err()
+
+		qm.cancel()
+		qm.wg.Wait()
+		if qm.diskQueue != nil {
+			if err := qm.diskQueue.Close(); err != nil {
+				qm.setLastErr(err)
+			}
+		}
+	})
+	return err
+}
+
+// Append queues a series for sending. While the shard the series belongs to is full, it
+// waits until there is room again or ctx is done. Series can only be appended between
+// Start and Stop.
+func (qm *QueueManager) Append(ctx context.Context, labels []prompb.Label, series typesv2.TimeSeries) error {
+	return qm.append(ctx, pendingSeries{labels: labels, series: series})
+}
+
+func (qm *QueueManager) append(ctx context.Context, s pendingSeries) error {
+	labels := s.labels
+	hash := hashLabels(labels)
+	for {
+		qm.shardsMtx.RLock()
+		if len(qm.shards) == 0 {
+			qm.shardsMtx.RUnlock()
+			return errQueueStopped
+		}
+		select {
+		case qm.shards[hash%uint64(len(qm.shards))].queue <- s:
+			qm.shardsMtx.RUnlock()
+			qm.dataIn.incr(1)
+			qm.pending.Add(1)
+			return nil
+		case <-ctx.Done():
+			qm.shardsMtx.RUnlock()
+			return ctx.Err()
+		case <-qm.quit:
+			qm.shardsMtx.RUnlock()
+			return errQueueStopped
+		case <-qm.resharding:
+			// Let go of the shards so that they can be replaced, and try the new ones.
+			qm.shardsMtx.RUnlock()
+		}
+	}
+}
+
+// NumShards is the number of shards currently running.
+func (qm *QueueManager) NumShards() int {
+	qm.shardsMtx.RLock()
+	defer qm.shardsMtx.RUnlock()
+	return len(qm.shards)
+}
+
+// SeriesSent and SeriesFailed count the series whose request succeeded or was dropped. With
+// a persistent queue, a series counts as sent once its request was written to disk; see
+// RequestsEvicted for those dropped from disk afterwards.
+func (qm *QueueManager) SeriesSent() int64   { return qm.seriesSent.Load() }
+func (qm *QueueManager) SeriesFailed() int64 { return qm.seriesFailed.Load() }
+
+// RequestsEvicted is the number of requests the persistent queue dropped, oldest first,
+// before they were sent because it outgrew its maximum size.
+func (qm *QueueManager) RequestsEvicted() int64 { return qm.requestsEvicted.Load() }
+
+// SymbolBytesSaved is the number of bytes, before compression, saved by compacting the
+// symbols tables of the requests, if enabled. It counts the symbols dropped and the bytes
+// of the references, see SymbolsCompaction.RefsSaved, so the actual savings may be a little
+// higher.
+func (qm *QueueManager) SymbolBytesSaved() int64 { return qm.symbolBytesSaved.Load() }
+
+// LastError returns the error of the last request that had to be dropped.
+func (qm *QueueManager) LastError() error {
+	qm.errMtx.Lock()
+	defer qm.errMtx.Unlock()
+	return qm.lastErr
+}
+
+func (qm *QueueManager) setLastErr(err error) {
+	qm.errMtx.Lock()
+	defer qm.errMtx.Unlock()
+	qm.lastErr = err
+}
+
+func (qm *QueueManager) startShards(n int) {
+	qm.shards = make([]*shard, n)
+	for i := range qm.shards {
+		qm.shards[i] = &shard{
+			qm:      qm,
+			queue:   make(chan pendingSeries, qm.cfg.Capacity),
+			done:    make(chan struct{}),
+			symbols: NewSymbolsTable(),
+		}
+		go qm.shards[i].run()
+	}
+	qm.numShards = n
+}
+
+// stopShards closes every queue and waits until the shards have sent what they had buffered.
+// Doing this before starting a new set of shards keeps the per series ordering across reshards.
+func (qm *QueueManager) stopShards() {
+	for _, s := range qm.shards {
+		close(s.queue)
+	}
+	for _, s := range qm.shards {
+		<-s.done
+	}
+	qm.shards = nil
+}
+
+func (qm *QueueManager) updateShardsLoop() {
+	defer qm.wg.Done()
+
+	ticker := time.NewTicker(qm.cfg.ShardUpdateDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			desired := qm.calculateDesiredShards()
+			if desired == qm.numShards {
+				continue
+			}
+			close(qm.resharding)
+			qm.shardsMtx.Lock()
+			select {
+			case <-qm.quit:
+				// Stop got the lock first, the shards must stay down.
+			default:
+				qm.stopShards()
+				qm.startShards(desired)
+			}
+			qm.resharding = make(chan struct{})
+			qm.shardsMtx.Unlock()
+		case <-qm.quit:
+			return
+		}
+	}
+}
+
+// calculateDesiredShards estimates how many shards are needed to keep up with the incoming
+// series given how long it takes to send one, plus some extra to work off the backlog.
+func (qm *QueueManager) calculateDesiredShards() int {
+	qm.dataIn.tick()
+	qm.dataOut.tick()
+	qm.dataOutDuration.tick()
+
+	var (
+		dataInRate      = qm.dataIn.rate()
+		dataOutRate     = qm.dataOut.rate()
+		dataOutDuration = qm.dataOutDuration.rate() / float64(time.Second)
+	)
+	if dataOutRate <= 0 {
+		return qm.numShards
+	}
+
+	var (
+		timePerSeries = dataOutDuration / dataOutRate
+		backlog       = float64(qm.pending.Load()) / qm.cfg.ShardUpdateDuration.Seconds()
+		desiredShards = timePerSeries * (dataInRate + backlogGain*backlog)
+	)
+
+	lowerBound := float64(qm.numShards) * (1. - shardToleranceFraction)
+	upperBound := float64(qm.numShards) * (1. + shardToleranceFraction)
+	if lowerBound <= desiredShards && desiredShards <= upperBound {
+		return qm.numShards
+	}
+
+	numShards := int(math.Ceil(desiredShards))
+	if numShards > qm.cfg.MaxShards {
+		numShards = qm.cfg.MaxShards
+	} else if numShards < qm.cfg.MinShards {
+		numShards = qm.cfg.MinShards
+	}
+	return numShards
+}
+
+type shard struct {
+	qm    *QueueManager
+	queue chan pendingSeries
+	done  chan struct{}
+	// symbols, timeSeries and refs are reused for the requests of the shard, which are
+	// sent one at a time, and so is the scratch space of their compaction.
+	symbols    symbolsTable
+	timeSeries []typesv2.TimeSeries
+	refs       []uint32
+	compactor  symbolsCompactor
+}
+
+func (s *shard) run() {
+	defer close(s.done)
+
+	var (
+		batch   []pendingSeries
+		samples int
+		bytes   int
+		timer   = time.NewTimer(s.qm.cfg.BatchSendDeadline)
+	)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			s.send(batch)
+		}
+		clear(batch)
+		batch, samples, bytes = batch[:0], 0, 0
+	}
+
+	for {
+		select {
+		case series, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, series)
+			samples += series.size()
+			bytes += series.bytes()
+			if samples >= s.qm.cfg.MaxSamplesPerSend ||
+				s.qm.cfg.MaxBytesPerSend > 0 && bytes >= s.qm.cfg.MaxBytesPerSend {
+				flush()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(s.qm.cfg.BatchSendDeadline)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(s.qm.cfg.BatchSendDeadline)
+		}
+	}
+}
+
+// send builds a request with its own symbols table out of the batch and sends it. The
+// buffers of the series are released once it was sent. With SeriesOrderLabels, the series of
+// the batch are sorted by label set first.
+func (s *shard) send(batch []pendingSeries) {
+	if s.qm.clientCfg.SeriesOrder == SeriesOrderLabels {
+		// The samples of a series keep their order.
+		slices.SortStableFunc(batch, func(a, b pendingSeries) int {
+			return compareLabels(a.labels, b.labels)
+		})
+	}
+	s.symbols.Reset()
+	s.timeSeries = s.timeSeries[:0]
+	s.refs = s.refs[:0]
+	for _, p := range batch {
+		series := p.series
+		start := len(s.refs)
+		s.refs = appendLabelRefs(s.refs, &s.symbols, p.labels)
+		series.LabelsRefs = s.refs[start:len(s.refs):len(s.refs)]
+		s.timeSeries = append(s.timeSeries, series)
+	}
+	req := typesv2.Request{Symbols: s.symbols.symbols, Timeseries: s.timeSeries}
+	defer func() {
+		for _, p := range batch {
+			p.release()
+		}
+		// Don't keep the histograms handed back alive.
+		clear(s.timeSeries)
+	}()
+
+	begin := time.Now()
+	failed, err := s.sendRequest(&req)
+	s.qm.dataOutDuration.incr(int64(time.Since(begin)))
+	s.qm.dataOut.incr(int64(len(batch)))
+	s.qm.pending.Add(-int64(len(batch)))
+
+	s.qm.seriesFailed.Add(int64(failed))
+	s.qm.seriesSent.Add(int64(len(batch) - failed))
+	if err != nil {
+		s.qm.setLastErr(err)
+	}
+}
+
+// sendRequest sends req, split as the limits require, and returns how many of its series
+// were dropped: those too large for a request on their own and those of failed requests.
+func (s *shard) sendRequest(req *typesv2.Request) (int, error) {
+	requests, err := splitRequest(req, s.qm.clientCfg.Limits)
+	if requests == nil && err != nil {
+		return len(req.Timeseries), err
+	}
+
+	failed := len(multierr.Errors(err))
+	errs := []error{err}
+	for i := range requests {
+		if s.qm.clientCfg.CompactSymbols {
+			s.qm.symbolBytesSaved.Add(int64(s.compactor.compact(&requests[i], false).RefsSaved))
+		}
+		body, err := s.qm.encoder.Encode(&requests[i])
+		if err == nil {
+			if s.qm.diskQueue != nil {
+				var evicted int
+				evicted, err = s.qm.diskQueue.Append(body)
+				s.qm.reportEvicted(evicted)
+			} else {
+				err = sendEncoded(s.qm.ctx, s.qm.client, s.qm.clientCfg, body)
+			}
+		}
+		if err != nil {
+			failed += len(requests[i].Timeseries)
+			errs = append(errs, err)
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+// reportEvicted logs and counts the requests the persistent queue had to drop before they
+// were sent. Their series were counted as sent when they were written to disk.
+func (qm *QueueManager) reportEvicted(requests int) {
+	if requests == 0 {
+		return
+	}
+	total := qm.requestsEvicted.Add(int64(requests))
+	qm.setLastErr(fmt.Errorf("persistent queue full: evicted %d requests that were never sent", requests))
+	qm.logger.Warn("Evicted requests from the full persistent queue before they were sent",
+		zap.Int("requests", requests), zap.Int64("total", total))
+}
+
+// runDiskSender sends the requests persisted by the shards, oldest first. A request is only
+// removed from disk once it was delivered or rejected for good; anything else is tried again
+// until the queue manager stops, and picked up on the next start.
+func (qm *QueueManager) runDiskSender() {
+	defer qm.wg.Done()
+
+	for {
+		body, err := qm.diskQueue.Peek()
+		if errors.Is(err, errQueueEmpty) {
+			select {
+			case <-qm.diskQueue.Notify():
+				continue
+			case <-qm.quit:
+				return
+			}
+		}
+		if err == nil {
+			err = sendEncoded(qm.ctx, qm.client, qm.clientCfg, body)
+			var sendErr *SendError
+			if errors.As(err, &sendErr) && !sendErr.Retryable {
+				// Sending it again won't help, drop it.
+				qm.setLastErr(err)
+				err = nil
+			}
+			if err == nil {
+				err = qm.diskQueue.Ack()
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		qm.setLastErr(err)
+		select {
+		case <-time.After(qm.cfg.BatchSendDeadline):
+		case <-qm.quit:
+			return
+		}
+	}
+}
+
+// hashLabels hashes a label set, it only needs to be stable within the process.
+func hashLabels(labels []prompb.Label) uint64 {
+	h := fnv.New64a()
+	for _, l := range labels {
+		_, _ = h.Write([]byte(l.Name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(l.Value))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
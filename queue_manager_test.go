@@ -0,0 +1,264 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"prometheusrwexporter-demo/rwtest"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// recordingServer decodes every request it receives and keeps the timestamps of the samples
+// per series, keyed by the value of the "series" label.
+type recordingServer struct {
+	*httptest.Server
+	mtx      sync.Mutex
+	requests int
+	received map[string][]int64
+}
+
+func newRecordingServer(t *testing.T) *recordingServer {
+	rs := &recordingServer{received: map[string][]int64{}}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := snappyEncoder{}.Decode(body)
+		assert.NoError(t, err)
+
+		rs.mtx.Lock()
+		defer rs.mtx.Unlock()
+		rs.requests++
+		for _, ts := range req.Timeseries {
+			name := ""
+			for i := 0; i < len(ts.LabelsRefs); i += 2 {
+				if req.Symbols[ts.LabelsRefs[i]] == "series" {
+					name = req.Symbols[ts.LabelsRefs[i+1]]
+				}
+			}
+			for _, s := range ts.Samples {
+				rs.received[name] = append(rs.received[name], s.Timestamp)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return rs
+}
+
+func testQueueConfig() QueueConfig {
+	return QueueConfig{
+		Capacity:            10,
+		MinShards:           4,
+		MaxShards:           8,
+		MaxSamplesPerSend:   5,
+		BatchSendDeadline:   10 * time.Millisecond,
+		ShardUpdateDuration: time.Hour,
+	}
+}
+
+func TestQueueManagerPreservesOrderPerSeries(t *testing.T) {
+	server := newRecordingServer(t)
+	defer server.Close()
+
+	qm, err := NewQueueManager(testQueueConfig(), httpClientConfig{Endpoint: server.URL}, zap.NewNop())
+	assert.NoError(t, err)
+	qm.Start()
+
+	const seriesCount, samplesPerSeries = 20, 10
+	for ts := int64(0); ts < samplesPerSeries; ts++ {
+		for i := 0; i < seriesCount; i++ {
+			labels := []prompb.Label{{Name: "series", Value: fmt.Sprint(i)}}
+			assert.NoError(t, qm.Append(context.Background(), labels, typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1, Timestamp: ts}}}))
+		}
+	}
+	qm.Stop(context.Background())
+
+	assert.Equal(t, int64(seriesCount*samplesPerSeries), qm.SeriesSent())
+	assert.Equal(t, int64(0), qm.SeriesFailed())
+	assert.Len(t, server.received, seriesCount)
+	for name, timestamps := range server.received {
+		assert.IsIncreasing(t, timestamps, "samples of series %v were reordered", name)
+	}
+	assert.Greater(t, server.requests, 1, "series should be split over several requests")
+}
+
+func TestQueueManagerSendsOnceBatchReachesMaxBytes(t *testing.T) {
+	server := newRecordingServer(t)
+	defer server.Close()
+
+	newSeries := func(i int) pendingSeries {
+		return pendingSeries{
+			labels: []prompb.Label{{Name: "series", Value: fmt.Sprint(i % 10)}},
+			series: typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1, Timestamp: 1}}},
+		}
+	}
+	cfg := testQueueConfig()
+	cfg.MinShards, cfg.MaxShards = 1, 1
+	cfg.MaxSamplesPerSend = 1000
+	cfg.MaxBytesPerSend = 10 * newSeries(0).bytes()
+	cfg.BatchSendDeadline = time.Hour
+	qm, err := NewQueueManager(cfg, httpClientConfig{Endpoint: server.URL}, zap.NewNop())
+	assert.NoError(t, err)
+	qm.Start()
+
+	for i := 0; i < 30; i++ {
+		s := newSeries(i)
+		assert.NoError(t, qm.Append(context.Background(), s.labels, s.series))
+	}
+	qm.Stop(context.Background())
+
+	assert.Equal(t, int64(30), qm.SeriesSent())
+	assert.Equal(t, 3, server.requests, "every 10 series should make a request")
+}
+
+func TestQueueManagerReshardsOnLatency(t *testing.T) {
+	cfg := testQueueConfig()
+	cfg.MinShards = 1
+	cfg.ShardUpdateDuration = time.Second
+	qm, err := NewQueueManager(cfg, httpClientConfig{}, zap.NewNop())
+	assert.NoError(t, err)
+
+	// Sending 100 series takes 1s, but 300 come in every second: we need three shards.
+	qm.dataIn.incr(300)
+	qm.dataOut.incr(100)
+	qm.dataOutDuration.incr(int64(time.Second))
+	assert.Equal(t, 3, qm.calculateDesiredShards())
+
+	// More than we are allowed to have.
+	qm.dataIn.incr(30000)
+	qm.dataOut.incr(100)
+	qm.dataOutDuration.incr(int64(time.Second))
+	assert.Equal(t, cfg.MaxShards, qm.calculateDesiredShards())
+}
+
+func TestV2WriteRequestBuilderEnqueue(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		series int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := snappyEncoder{}.Decode(body)
+		assert.NoError(t, err)
+		mtx.Lock()
+		series += len(req.Timeseries)
+		mtx.Unlock()
+	}))
+	defer server.Close()
+
+	clientCfg := httpClientConfig{Endpoint: server.URL}
+	qm, err := NewQueueManager(testQueueConfig(), clientCfg, zap.NewNop())
+	assert.NoError(t, err)
+	qm.Start()
+
+	builder, err := NewV2RequestBuilder(PrepareDummyExportRequest(), clientCfg)
+	assert.NoError(t, err)
+	assert.NoError(t, builder.Enqueue(context.Background(), qm))
+	qm.Stop(context.Background())
+
+	assert.Equal(t, 5, series, "every metric of the dummy request should have been sent")
+}
+
+func TestQueueManagerAppendOutsideStartAndStop(t *testing.T) {
+	server := newRecordingServer(t)
+	defer server.Close()
+
+	qm, err := NewQueueManager(testQueueConfig(), httpClientConfig{Endpoint: server.URL}, zap.NewNop())
+	assert.NoError(t, err)
+	labels := []prompb.Label{{Name: "series", Value: "0"}}
+	series := typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1}}}
+
+	assert.ErrorIs(t, qm.Append(context.Background(), labels, series), errQueueStopped)
+	qm.Start()
+	assert.NoError(t, qm.Append(context.Background(), labels, series))
+	qm.Stop(context.Background())
+	qm.Stop(context.Background())
+	assert.ErrorIs(t, qm.Append(context.Background(), labels, series), errQueueStopped)
+	assert.Equal(t, int64(1), qm.SeriesSent())
+}
+
+func TestQueueManagerAppendGivesUpWhenContextIsDone(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+
+	cfg := testQueueConfig()
+	cfg.MinShards, cfg.Capacity, cfg.MaxSamplesPerSend = 1, 1, 1
+	qm, err := NewQueueManager(cfg, httpClientConfig{Endpoint: server.URL}, zap.NewNop())
+	assert.NoError(t, err)
+	qm.Start()
+	defer qm.Stop(context.Background())
+	defer close(unblock)
+
+	// The shard is stuck sending the first series, the second fills its queue.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var appendErr error
+	for i := 0; i < 3 && appendErr == nil; i++ {
+		appendErr = qm.Append(ctx, []prompb.Label{{Name: "series", Value: fmt.Sprint(i)}}, typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1}}})
+	}
+	assert.ErrorIs(t, appendErr, context.DeadlineExceeded)
+	assert.Equal(t, 1, qm.NumShards(), "the shards should not be locked while Append waits")
+}
+
+func TestQueueManagerDropsOnlyOversizedSeries(t *testing.T) {
+	server := newRecordingServer(t)
+	defer server.Close()
+
+	cfg := testQueueConfig()
+	cfg.MinShards, cfg.MaxSamplesPerSend = 1, 1000
+	qm, err := NewQueueManager(cfg, httpClientConfig{Endpoint: server.URL, Limits: RequestLimits{MaxBytes: 256}}, zap.NewNop())
+	assert.NoError(t, err)
+	qm.Start()
+	for i := 0; i < 5; i++ {
+		series := typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1}}}
+		for j := 1; i == 2 && j < 100; j++ {
+			series.Samples = append(series.Samples, typesv2.Sample{Value: 1, Timestamp: int64(j)})
+		}
+		assert.NoError(t, qm.Append(context.Background(), []prompb.Label{{Name: "series", Value: fmt.Sprint(i)}}, series))
+	}
+	qm.Stop(context.Background())
+
+	assert.Equal(t, int64(4), qm.SeriesSent())
+	assert.Equal(t, int64(1), qm.SeriesFailed())
+	assert.ErrorIs(t, qm.LastError(), ErrSeriesTooLarge)
+	assert.Len(t, server.received, 4)
+	assert.NotContains(t, server.received, "2")
+}
+
+func TestQueueManagerSortsBatchesByLabels(t *testing.T) {
+	server := rwtest.NewServer()
+	defer server.Close()
+
+	cfg := testQueueConfig()
+	cfg.MinShards, cfg.MaxSamplesPerSend, cfg.BatchSendDeadline = 1, 1000, time.Hour
+	qm, err := NewQueueManager(cfg, httpClientConfig{Endpoint: server.URL, SeriesOrder: SeriesOrderLabels}, zap.NewNop())
+	assert.NoError(t, err)
+	qm.Start()
+	for ts := int64(0); ts < 2; ts++ {
+		for i := 9; i >= 0; i-- {
+			labels := []prompb.Label{{Name: "series", Value: fmt.Sprint(i)}}
+			assert.NoError(t, qm.Append(context.Background(), labels, typesv2.TimeSeries{Samples: []typesv2.Sample{{Value: 1, Timestamp: ts}}}))
+		}
+	}
+	qm.Stop(context.Background())
+
+	requests := server.Requests()
+	require.Len(t, requests, 1)
+	var order []string
+	for _, ts := range requests[0].Timeseries {
+		order = append(order, fmt.Sprintf("%s@%d", requests[0].Symbols[ts.LabelsRefs[1]], ts.Samples[0].Timestamp))
+	}
+	assert.Equal(t, []string{"0@0", "0@1", "1@0", "1@1", "2@0", "2@1", "3@0", "3@1", "4@0", "4@1",
+		"5@0", "5@1", "6@0", "6@1", "7@0", "7@1", "8@0", "8@1", "9@0", "9@1"}, order)
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package prometheusremotewritev2
+
+// raceEnabled tells whether the race detector is on, under which sync.Pool drops items at
+// random and allocation counts mean nothing.
+const raceEnabled = true
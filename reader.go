@@ -0,0 +1,272 @@
+package prometheusremotewritev2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/model/labels"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+var ErrInvalidRequest = errors.New("invalid remote write 2.0 request")
+
+// Series is a series of a request with every reference resolved.
+type Series struct {
+	Labels           labels.Labels
+	Metadata         Metadata
+	Samples          []typesv2.Sample
+	Histograms       []typesv2.Histogram
+	Exemplars        []Exemplar
+	CreatedTimestamp int64
+}
+
+type Metadata struct {
+	Type typesv2.Metadata_MetricType
+	Help string
+	Unit string
+}
+
+type Exemplar struct {
+	Labels    labels.Labels
+	Value     float64
+	Timestamp int64
+}
+
+// RequestReader reads the series of a request whose references were all checked against its
+// symbols table.
+type RequestReader struct {
+	req *typesv2.Request
+}
+
+// NewRequestReader validates the request: the symbols table must start with the empty
+// string, every reference must be within it, and label sets must come in name/value pairs
+// with unique, non-empty names.
+func NewRequestReader(req *typesv2.Request) (*RequestReader, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	return &RequestReader{req: req}, nil
+}
+
+// DecodeRequest decodes a snappy compressed request, as found in a request body.
+func DecodeRequest(body []byte) (*RequestReader, error) {
+	req, err := snappyEncoder{}.Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	return NewRequestReader(req)
+}
+
+func (r *RequestReader) Request() *typesv2.Request {
+	return r.req
+}
+
+// Len is the number of series in the request.
+func (r *RequestReader) Len() int {
+	return len(r.req.Timeseries)
+}
+
+// Series resolves the i-th series of the request.
+func (r *RequestReader) Series(i int) Series {
+	ts := &r.req.Timeseries[i]
+	s := Series{
+		Labels: r.labels(ts.LabelsRefs),
+		Metadata: Metadata{
+			Type: ts.Metadata.Type,
+			Help: r.req.Symbols[ts.Metadata.HelpRef],
+			Unit: r.req.Symbols[ts.Metadata.UnitRef],
+		},
+		Samples:          ts.Samples,
+		Histograms:       ts.Histograms,
+		CreatedTimestamp: ts.CreatedTimestamp,
+	}
+	for _, e := range ts.Exemplars {
+		s.Exemplars = append(s.Exemplars, Exemplar{
+			Labels:    r.labels(e.LabelsRefs),
+			Value:     e.Value,
+			Timestamp: e.Timestamp,
+		})
+	}
+	return s
+}
+
+// Iterator returns an iterator over the series of the request, in order.
+func (r *RequestReader) Iterator() *SeriesIterator {
+	return &SeriesIterator{r: r, i: -1}
+}
+
+func (r *RequestReader) labels(refs []uint32) labels.Labels {
+	b := labels.NewScratchBuilder(len(refs) / 2)
+	for i := 0; i < len(refs); i += 2 {
+		b.Add(r.req.Symbols[refs[i]], r.req.Symbols[refs[i+1]])
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// Bucket is a bucket of a native histogram.
+type Bucket struct {
+	Lower, Upper float64
+	// LowerInclusive and UpperInclusive tell whether the bounds belong to the bucket.
+	LowerInclusive, UpperInclusive bool
+	Count                          float64
+}
+
+// HistogramBuckets returns the non-empty buckets of a native histogram, the zero bucket
+// included, in increasing order of their bounds. Unlike the spans and counts they are
+// resolved from, they do not depend on how the histogram is encoded.
+func HistogramBuckets(h typesv2.Histogram) ([]Bucket, error) {
+	var buckets []Bucket
+	if h.Schema == customBucketsSchema {
+		if len(h.NegativeSpans) > 0 {
+			return nil, errors.New("custom buckets histogram with negative buckets")
+		}
+		first, counts, err := expandBucketCounts(h.PositiveSpans, h.PositiveDeltas, h.PositiveCounts)
+		if err != nil {
+			return nil, err
+		}
+		if first < 0 || int(first)+len(counts) > len(h.CustomValues)+1 {
+			return nil, fmt.Errorf("buckets [%d, %d) out of the %d custom buckets", first, int(first)+len(counts), len(h.CustomValues)+1)
+		}
+		for i, count := range counts {
+			idx := int(first) + i
+			b := Bucket{Lower: math.Inf(-1), Upper: math.Inf(1), UpperInclusive: true, Count: count}
+			if idx > 0 {
+				b.Lower = h.CustomValues[idx-1]
+			}
+			if idx < len(h.CustomValues) {
+				b.Upper = h.CustomValues[idx]
+			}
+			if count != 0 {
+				buckets = append(buckets, b)
+			}
+		}
+		return buckets, nil
+	}
+
+	if h.Schema < -4 || h.Schema > 8 {
+		return nil, fmt.Errorf("schema %d is out of the exponential schemas range [-4, 8]", h.Schema)
+	}
+	// Bucket i of an exponential schema s covers (2^((i-1)/2^s), 2^(i/2^s)].
+	bound := func(idx int32) float64 {
+		return math.Exp2(float64(idx) / math.Exp2(float64(h.Schema)))
+	}
+
+	first, counts, err := expandBucketCounts(h.NegativeSpans, h.NegativeDeltas, h.NegativeCounts)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(counts) - 1; i >= 0; i-- {
+		idx := first + int32(i)
+		if counts[i] != 0 {
+			buckets = append(buckets, Bucket{Lower: -bound(idx), Upper: -bound(idx - 1), LowerInclusive: true, Count: counts[i]})
+		}
+	}
+	if _, zeroCount := HistogramCounts(h); zeroCount != 0 {
+		buckets = append(buckets, Bucket{Lower: -h.ZeroThreshold, Upper: h.ZeroThreshold, LowerInclusive: true, UpperInclusive: true, Count: zeroCount})
+	}
+	first, counts, err = expandBucketCounts(h.PositiveSpans, h.PositiveDeltas, h.PositiveCounts)
+	if err != nil {
+		return nil, err
+	}
+	for i, count := range counts {
+		idx := first + int32(i)
+		if count != 0 {
+			buckets = append(buckets, Bucket{Lower: bound(idx - 1), Upper: bound(idx), UpperInclusive: true, Count: count})
+		}
+	}
+	return buckets, nil
+}
+
+// String renders the bucket as an interval, like (0.5, 1].
+func (b Bucket) String() string {
+	lower, upper := "(", "]"
+	if b.LowerInclusive {
+		lower = "["
+	}
+	if !b.UpperInclusive {
+		upper = ")"
+	}
+	return fmt.Sprintf("%s%g, %g%s", lower, b.Lower, b.Upper, upper)
+}
+
+// SeriesIterator walks the series of a request.
+//
+//	it := reader.Iterator()
+//	for it.Next() {
+//		series := it.At()
+//	}
+type SeriesIterator struct {
+	r *RequestReader
+	i int
+}
+
+func (it *SeriesIterator) Next() bool {
+	if it.i+1 >= it.r.Len() {
+		it.i = it.r.Len()
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *SeriesIterator) At() Series {
+	return it.r.Series(it.i)
+}
+
+func validateRequest(req *typesv2.Request) error {
+	if len(req.Symbols) == 0 || req.Symbols[0] != "" {
+		return fmt.Errorf("%w: the symbols table must start with an empty string", ErrInvalidRequest)
+	}
+
+	checkRef := func(ref uint32) error {
+		if int(ref) >= len(req.Symbols) {
+			return fmt.Errorf("reference %d out of bounds of %d symbols", ref, len(req.Symbols))
+		}
+		return nil
+	}
+	checkLabels := func(refs []uint32) error {
+		if len(refs)%2 != 0 {
+			return fmt.Errorf("odd number of label references: %d", len(refs))
+		}
+		seen := make(map[string]struct{}, len(refs)/2)
+		for i := 0; i < len(refs); i += 2 {
+			if err := checkRef(refs[i]); err != nil {
+				return err
+			}
+			if err := checkRef(refs[i+1]); err != nil {
+				return err
+			}
+			name := req.Symbols[refs[i]]
+			if name == "" {
+				return errors.New("empty label name")
+			}
+			if _, ok := seen[name]; ok {
+				return fmt.Errorf("duplicate label name %q", name)
+			}
+			seen[name] = struct{}{}
+		}
+		return nil
+	}
+
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		err := checkLabels(ts.LabelsRefs)
+		if err == nil {
+			err = checkRef(ts.Metadata.HelpRef)
+		}
+		if err == nil {
+			err = checkRef(ts.Metadata.UnitRef)
+		}
+		for j := 0; err == nil && j < len(ts.Exemplars); j++ {
+			if err = checkLabels(ts.Exemplars[j].LabelsRefs); err != nil {
+				err = fmt.Errorf("exemplar %d: %w", j, err)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%w: series %d: %v", ErrInvalidRequest, i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package prometheusremotewritev2
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+func TestRequestReaderResolvesReferences(t *testing.T) {
+	symbols := NewSymbolsTable()
+	req := typesv2.Request{
+		Timeseries: []typesv2.TimeSeries{{
+			// Deliberately out of order.
+			LabelsRefs: symbolizeLabelRefs(&symbols, []prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "http_requests_total"}}),
+			Metadata: typesv2.Metadata{
+				Type:    typesv2.Metadata_METRIC_TYPE_COUNTER,
+				HelpRef: symbols.Symbolize("Total HTTP requests."),
+			},
+			Samples: []typesv2.Sample{{Value: 42, Timestamp: 1000}},
+			Exemplars: []typesv2.Exemplar{{
+				LabelsRefs: symbolizeLabelRefs(&symbols, []prompb.Label{{Name: "trace_id", Value: "abc"}}),
+				Value:      1,
+				Timestamp:  900,
+			}},
+		}},
+	}
+	req.Symbols = symbols.symbols
+
+	reader, err := NewRequestReader(&req)
+	require.NoError(t, err)
+	require.Equal(t, 1, reader.Len())
+
+	it := reader.Iterator()
+	require.True(t, it.Next())
+	series := it.At()
+	assert.Equal(t, labels.FromStrings("__name__", "http_requests_total", "job", "api"), series.Labels)
+	assert.Equal(t, Metadata{Type: typesv2.Metadata_METRIC_TYPE_COUNTER, Help: "Total HTTP requests."}, series.Metadata)
+	assert.Equal(t, []typesv2.Sample{{Value: 42, Timestamp: 1000}}, series.Samples)
+	assert.Equal(t, []Exemplar{{Labels: labels.FromStrings("trace_id", "abc"), Value: 1, Timestamp: 900}}, series.Exemplars)
+	assert.False(t, it.Next())
+}
+
+func TestRequestReaderReadsBuilderOutput(t *testing.T) {
+	builder, err := NewV2RequestBuilder(PrepareDummyExportRequest(), httpClientConfig{})
+	require.NoError(t, err)
+	builder.CreateRequest()
+	body, err := builder.encoder.Encode(&builder.request)
+	require.NoError(t, err)
+
+	reader, err := DecodeRequest(body)
+	require.NoError(t, err)
+	for it := reader.Iterator(); it.Next(); {
+		series := it.At()
+		names := []string{}
+		series.Labels.Range(func(l labels.Label) { names = append(names, l.Name) })
+		assert.IsIncreasing(t, names, "labels should be sorted and unique")
+		assert.Equal(t, 21, series.Labels.Len(), "10 resource attributes, 10 data point attributes and the name")
+		assert.Len(t, series.Histograms, 1)
+	}
+}
+
+func TestRequestReaderRejectsInvalidRequests(t *testing.T) {
+	valid := func() typesv2.Request {
+		return typesv2.Request{
+			Symbols:    []string{"", "__name__", "up", "help"},
+			Timeseries: []typesv2.TimeSeries{{LabelsRefs: []uint32{1, 2}, Metadata: typesv2.Metadata{HelpRef: 3}}},
+		}
+	}
+	tests := map[string]func(req *typesv2.Request){
+		"no symbols":             func(req *typesv2.Request) { req.Symbols = nil },
+		"first symbol not empty": func(req *typesv2.Request) { req.Symbols[0] = "x" },
+		"label ref out of range": func(req *typesv2.Request) { req.Timeseries[0].LabelsRefs[1] = 4 },
+		"odd label refs":         func(req *typesv2.Request) { req.Timeseries[0].LabelsRefs = []uint32{1} },
+		"empty label name":       func(req *typesv2.Request) { req.Timeseries[0].LabelsRefs = []uint32{0, 2} },
+		"duplicate label name":   func(req *typesv2.Request) { req.Timeseries[0].LabelsRefs = []uint32{1, 2, 1, 3} },
+		"help ref out of range":  func(req *typesv2.Request) { req.Timeseries[0].Metadata.HelpRef = 4 },
+		"unit ref out of range":  func(req *typesv2.Request) { req.Timeseries[0].Metadata.UnitRef = 4 },
+		"exemplar ref out of range": func(req *typesv2.Request) {
+			req.Timeseries[0].Exemplars = []typesv2.Exemplar{{LabelsRefs: []uint32{1, 5}}}
+		},
+	}
+
+	req := valid()
+	_, err := NewRequestReader(&req)
+	require.NoError(t, err)
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := valid()
+			modify(&req)
+			_, err := NewRequestReader(&req)
+			assert.ErrorIs(t, err, ErrInvalidRequest)
+		})
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	buckets, err := HistogramBuckets(typesv2.Histogram{
+		Schema:         0,
+		ZeroThreshold:  0.001,
+		ZeroCount:      &typesv2.Histogram_ZeroCountInt{ZeroCountInt: 1},
+		NegativeSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 2}},
+		NegativeDeltas: []int64{1, 1},
+		// Buckets 1 and 3, with an empty one in between.
+		PositiveSpans:  []typesv2.BucketSpan{{Offset: 1, Length: 3}},
+		PositiveDeltas: []int64{3, -3, 1},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[-2, -1)", "[-1, -0.5)", "[-0.001, 0.001]", "(1, 2]", "(4, 8]"}, bucketStrings(buckets))
+	assert.Equal(t, []float64{2, 1, 1, 3, 1}, bucketCounts(buckets))
+
+	buckets, err = HistogramBuckets(typesv2.Histogram{
+		Schema:         customBucketsSchema,
+		CustomValues:   []float64{1, 5},
+		PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 1}, {Offset: 1, Length: 1}},
+		PositiveCounts: []float64{2.5, 1},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"(-Inf, 1]", "(5, +Inf]"}, bucketStrings(buckets))
+	assert.Equal(t, []float64{2.5, 1}, bucketCounts(buckets))
+
+	_, err = HistogramBuckets(typesv2.Histogram{Schema: customBucketsSchema, PositiveSpans: []typesv2.BucketSpan{{Offset: 1, Length: 1}}, PositiveDeltas: []int64{1}})
+	assert.Error(t, err)
+	_, err = HistogramBuckets(typesv2.Histogram{Schema: 9})
+	assert.Error(t, err)
+}
+
+func bucketStrings(buckets []Bucket) []string {
+	var out []string
+	for _, b := range buckets {
+		out = append(out, b.String())
+	}
+	return out
+}
+
+func bucketCounts(buckets []Bucket) []float64 {
+	var out []float64
+	for _, b := range buckets {
+		out = append(out, b.Count)
+	}
+	return out
+}
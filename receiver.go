@@ -0,0 +1,229 @@
+package prometheusremotewritev2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+const (
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+
+	protobufMediaType = "application/x-protobuf"
+	protoV1           = "prometheus.WriteRequest"
+	protoV2           = "io.prometheus.write.v2.Request"
+
+	// maxRequestBytes bounds the size of a request body, before and after decompression.
+	maxRequestBytes = 32 << 20
+)
+
+// WriteStats counts what a Consumer wrote out of a request.
+type WriteStats struct {
+	Samples    int
+	Histograms int
+	Exemplars  int
+}
+
+// RequestStats counts everything in the request.
+func RequestStats(reader *RequestReader) WriteStats {
+	var stats WriteStats
+	for _, ts := range reader.Request().Timeseries {
+		stats.Samples += len(ts.Samples)
+		stats.Histograms += len(ts.Histograms)
+		stats.Exemplars += len(ts.Exemplars)
+	}
+	return stats
+}
+
+// Consumer is handed the requests accepted by a Handler. It returns what it wrote, which
+// may be part of the request only, along with an error when it did not write everything.
+// Errors wrapping ErrInvalidRequest or a ConversionError, or marked permanent with
+// consumererror.NewPermanent, are the sender's fault; any other error is assumed to be
+// temporary and the sender is asked to retry.
+type Consumer interface {
+	Consume(ctx context.Context, reader *RequestReader) (WriteStats, error)
+}
+
+// ConsumerFunc adapts a function into a Consumer.
+type ConsumerFunc func(ctx context.Context, reader *RequestReader) (WriteStats, error)
+
+func (f ConsumerFunc) Consume(ctx context.Context, reader *RequestReader) (WriteStats, error) {
+	return f(ctx, reader)
+}
+
+// NewMetricsConsumer returns a Consumer converting the requests with RequestToMetrics and
+// passing the metrics on to next. Histograms that cannot be converted are not counted as
+// written, and the sender is told about them.
+func NewMetricsConsumer(next consumer.Metrics) Consumer {
+	return ConsumerFunc(func(ctx context.Context, reader *RequestReader) (WriteStats, error) {
+		md, convErr := RequestToMetrics(reader.Request())
+		stats := RequestStats(reader)
+		stats.Histograms -= DroppedPoints(convErr)[ReasonInvalidHistogram]
+		if err := next.ConsumeMetrics(ctx, md); err != nil {
+			return WriteStats{}, err
+		}
+		return stats, convErr
+	})
+}
+
+// Handler serves the remote write 2.0 protocol: it decodes the requests POSTed to it and
+// hands them to its Consumer. Remote write 1.0 requests, told apart by the proto parameter
+// of their Content-Type, are accepted too and translated into 2.0 requests first.
+//
+// Requests are answered with 204 No Content once written, 415 Unsupported Media Type for
+// content types or encodings it does not know, 4xx for requests that must not be retried
+// and 5xx for those that may. The X-Prometheus-Remote-Write-*-Written headers tell what was
+// written in every case.
+type Handler struct {
+	consumer Consumer
+}
+
+func NewHandler(consumer Consumer) *Handler {
+	return &Handler{consumer: consumer}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	proto, err := protoMessage(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, status, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	req, err := unmarshalRequest(proto, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v: %v", ErrInvalidRequest, err), http.StatusBadRequest)
+		return
+	}
+	reader, err := NewRequestReader(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := h.consumer.Consume(r.Context(), reader)
+	w.Header().Set(samplesWrittenHeader, strconv.Itoa(stats.Samples))
+	w.Header().Set(histogramsWrittenHeader, strconv.Itoa(stats.Histograms))
+	w.Header().Set(exemplarsWrittenHeader, strconv.Itoa(stats.Exemplars))
+	if err != nil {
+		http.Error(w, err.Error(), consumeErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// protoMessage returns the message named by the proto parameter of the Content-Type. Like
+// the spec says, requests without one, or without a Content-Type at all, are 1.0 requests.
+func protoMessage(contentType string) (string, error) {
+	if contentType == "" {
+		return protoV1, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid Content-Type %q: %w", contentType, err)
+	}
+	if mediaType != protobufMediaType {
+		return "", fmt.Errorf("unsupported Content-Type %q, expected %q", contentType, contentTypeV2)
+	}
+	switch proto := params["proto"]; proto {
+	case "", protoV1:
+		return protoV1, nil
+	case protoV2:
+		return protoV2, nil
+	default:
+		return "", fmt.Errorf("unsupported proto %q, expected %q or %q", proto, protoV2, protoV1)
+	}
+}
+
+func unmarshalRequest(proto string, body []byte) (*typesv2.Request, error) {
+	if proto == protoV1 {
+		var v1 prompb.WriteRequest
+		if err := v1.Unmarshal(body); err != nil {
+			return nil, err
+		}
+		return TranslateV1Request(&v1), nil
+	}
+	var req typesv2.Request
+	if err := req.Unmarshal(body); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// readBody reads and decompresses the request body, returning the status to reply with if
+// it cannot.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("reading body: %w", err)
+	}
+
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	// snappy is the only encoding the spec requires, and the one to assume when none is given.
+	case "", "snappy":
+		n, err := snappy.DecodedLen(compressed)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("decompressing body: %w", err)
+		}
+		if n > maxRequestBytes {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed body of %d bytes exceeds %d bytes", n, maxRequestBytes)
+		}
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("decompressing body: %w", err)
+		}
+		return body, 0, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("decompressing body: %w", err)
+		}
+		body, err := io.ReadAll(io.LimitReader(zr, maxRequestBytes+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("decompressing body: %w", err)
+		}
+		if len(body) > maxRequestBytes {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed body exceeds %d bytes", maxRequestBytes)
+		}
+		return body, 0, nil
+	case "identity":
+		return compressed, 0, nil
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
+
+func consumeErrorStatus(err error) int {
+	var convErr *ConversionError
+	if errors.Is(err, ErrInvalidRequest) || errors.As(err, &convErr) || consumererror.IsPermanent(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
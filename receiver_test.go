@@ -0,0 +1,194 @@
+package prometheusremotewritev2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// post sends body to the server with the given content type and encoding.
+func post(t *testing.T, url, contentType, encoding string, body []byte) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", encoding)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestHandlerReceivesExporterRequests(t *testing.T) {
+	sink := &consumertest.MetricsSink{}
+	server := httptest.NewServer(NewHandler(NewMetricsConsumer(sink)))
+	defer server.Close()
+
+	builder, err := NewV2RequestBuilder(PrepareDummyExportRequest(), httpClientConfig{Endpoint: server.URL})
+	require.NoError(t, err)
+	builder.CreateRequest()
+	require.NoError(t, builder.send(context.Background()))
+
+	require.Len(t, sink.AllMetrics(), 1)
+	assert.Equal(t, 5, sink.AllMetrics()[0].DataPointCount())
+}
+
+func TestHandlerWrittenHeaders(t *testing.T) {
+	req := requestWithSeries(3, 2)
+	req.Timeseries[0].Histograms = []typesv2.Histogram{{Schema: 0, Timestamp: 1}}
+	pBuf, err := req.Marshal()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(NewHandler(ConsumerFunc(func(_ context.Context, reader *RequestReader) (WriteStats, error) {
+		return RequestStats(reader), nil
+	})))
+	defer server.Close()
+
+	for _, encoding := range []string{"snappy", "gzip", "identity"} {
+		t.Run(encoding, func(t *testing.T) {
+			body := pBuf
+			switch encoding {
+			case "snappy":
+				body = snappy.Encode(nil, pBuf)
+			case "gzip":
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				_, _ = zw.Write(pBuf)
+				require.NoError(t, zw.Close())
+				body = buf.Bytes()
+			}
+
+			resp := post(t, server.URL, contentTypeV2, encoding, body)
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+			assert.Equal(t, "6", resp.Header.Get(samplesWrittenHeader))
+			assert.Equal(t, "1", resp.Header.Get(histogramsWrittenHeader))
+			assert.Equal(t, "0", resp.Header.Get(exemplarsWrittenHeader))
+		})
+	}
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	valid := requestWithSeries(1, 1)
+	validBody, err := snappyEncoder{}.Encode(&valid)
+	require.NoError(t, err)
+	dangling := requestWithSeries(1, 1)
+	dangling.Timeseries[0].LabelsRefs[1] = 100
+	danglingBody, err := snappyEncoder{}.Encode(&dangling)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		consumeErr  error
+		status      int
+	}{
+		{"written", contentTypeV2, "snappy", validBody, nil, http.StatusNoContent},
+		{"unknown media type", "application/json", "snappy", validBody, nil, http.StatusUnsupportedMediaType},
+		{"unknown proto", "application/x-protobuf;proto=foo", "snappy", validBody, nil, http.StatusUnsupportedMediaType},
+		{"unknown encoding", contentTypeV2, "br", validBody, nil, http.StatusUnsupportedMediaType},
+		{"corrupt snappy", contentTypeV2, "snappy", []byte("not snappy"), nil, http.StatusBadRequest},
+		{"corrupt proto", contentTypeV2, "snappy", snappy.Encode(nil, []byte{0xff, 0xff}), nil, http.StatusBadRequest},
+		{"dangling reference", contentTypeV2, "snappy", danglingBody, nil, http.StatusBadRequest},
+		{"conversion error", contentTypeV2, "snappy", validBody, newConversionError(ReasonInvalidHistogram, "m", 1, "bad"), http.StatusBadRequest},
+		{"consumer failure", contentTypeV2, "snappy", validBody, errors.New("pipeline full"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(NewHandler(ConsumerFunc(func(_ context.Context, reader *RequestReader) (WriteStats, error) {
+				return RequestStats(reader), tt.consumeErr
+			})))
+			defer server.Close()
+
+			resp := post(t, server.URL, tt.contentType, tt.encoding, tt.body)
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+
+	server := httptest.NewServer(NewHandler(ConsumerFunc(func(context.Context, *RequestReader) (WriteStats, error) {
+		return WriteStats{}, nil
+	})))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHandlerAcceptsV1Requests(t *testing.T) {
+	v1 := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		Exemplars: []prompb.Exemplar{{
+			Labels:    []prompb.Label{{Name: "trace_id", Value: "abc"}},
+			Value:     1,
+			Timestamp: 900,
+		}},
+		Histograms: []prompb.Histogram{{
+			Count:          &prompb.Histogram_CountInt{CountInt: 3},
+			Sum:            4,
+			ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1},
+			PositiveSpans:  []prompb.BucketSpan{{Offset: 1, Length: 2}},
+			PositiveDeltas: []int64{1, 0},
+			Timestamp:      1000,
+		}},
+	}}}
+	pBuf, err := v1.Marshal()
+	require.NoError(t, err)
+
+	var received []Series
+	server := httptest.NewServer(NewHandler(ConsumerFunc(func(_ context.Context, reader *RequestReader) (WriteStats, error) {
+		for it := reader.Iterator(); it.Next(); {
+			received = append(received, it.At())
+		}
+		return RequestStats(reader), nil
+	})))
+	defer server.Close()
+
+	for _, contentType := range []string{"application/x-protobuf;proto=prometheus.WriteRequest", "application/x-protobuf", ""} {
+		received = nil
+		resp := post(t, server.URL, contentType, "snappy", snappy.Encode(nil, pBuf))
+		require.Equal(t, http.StatusNoContent, resp.StatusCode, contentType)
+		assert.Equal(t, "1", resp.Header.Get(samplesWrittenHeader))
+
+		require.Len(t, received, 1)
+		assert.Equal(t, labels.FromStrings("__name__", "up", "job", "api"), received[0].Labels)
+		assert.Equal(t, []typesv2.Sample{{Value: 1, Timestamp: 1000}}, received[0].Samples)
+		assert.Equal(t, []Exemplar{{Labels: labels.FromStrings("trace_id", "abc"), Value: 1, Timestamp: 900}}, received[0].Exemplars)
+		require.Len(t, received[0].Histograms, 1)
+		h := received[0].Histograms[0]
+		assert.Equal(t, uint64(3), h.GetCountInt())
+		assert.Equal(t, []typesv2.BucketSpan{{Offset: 1, Length: 2}}, h.PositiveSpans)
+		assert.Equal(t, []int64{1, 0}, h.PositiveDeltas)
+	}
+}
+
+func TestMetricsConsumerCountsDroppedHistograms(t *testing.T) {
+	req := typesv2.Request{
+		Symbols: []string{"", "__name__", "latency"},
+		Timeseries: []typesv2.TimeSeries{{
+			LabelsRefs: []uint32{1, 2},
+			Histograms: []typesv2.Histogram{{Schema: 9}, {Schema: 0, Timestamp: 1}},
+		}},
+	}
+	reader, err := NewRequestReader(&req)
+	require.NoError(t, err)
+
+	sink := &consumertest.MetricsSink{}
+	stats, err := NewMetricsConsumer(sink).Consume(context.Background(), reader)
+	assert.ErrorIs(t, err, ErrInvalidHistogram)
+	assert.Equal(t, WriteStats{Histograms: 1}, stats)
+	assert.Equal(t, 1, sink.DataPointCount())
+}
@@ -1,33 +1,86 @@
 package prometheusremotewritev2
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	typesv2 "prometheusrwexporter-demo/types"
-	"time"
+	"slices"
+	"strings"
 
 	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"go.uber.org/multierr"
 )
 
+// V2WriteRequestBuilder converts metrics into remote write 2.0 requests. The series, labels,
+// histograms and symbols of a build are kept for the next one, so that a builder reused
+// for batches of a similar shape hardly allocates once warmed up.
 type V2WriteRequestBuilder struct {
-	resources         pmetric.ResourceMetricsSlice
+	resources         []pmetric.ResourceMetrics
 	symbols           symbolsTable
 	scopeMetricSlices map[resourceID][]pmetric.Metric
 	request           typesv2.Request
 	tsSlice           []*ts
-	encoder           encoder
-	httpClient        httpClient
-	httpClientConfig  httpClientConfig
+	// resourceLabels is scratch space for the labels of the resource being converted.
+	resourceLabels []prompb.Label
+	// pointGroups is scratch space grouping the data points of the metric being converted
+	// into series.
+	pointGroups pointGroups
+	// workers convert the resources of large batches in parallel; see convertParallel.
+	workers          []*V2WriteRequestBuilder
+	remap            []uint32
+	compactor        symbolsCompactor
+	encoder          encoder
+	httpClient       *http.Client
+	httpClientConfig httpClientConfig
 }
 
-func NewV2RequestBuilder(exportReq pmetricotlp.ExportRequest, httpClientConfig httpClientConfig) (*V2WriteRequestBuilder, error) {
-	scopeMetricSlices := make(map[resourceID][]pmetric.Metric)
+// NewV2WriteRequestBuilder returns an empty builder. It can be reused for any number of
+// requests: Add metrics, Build the request, Reset, and start over.
+func NewV2WriteRequestBuilder(httpClientConfig httpClientConfig) (*V2WriteRequestBuilder, error) {
+	if err := httpClientConfig.Retry.Validate(); err != nil {
+		return nil, err
+	}
+	if err := httpClientConfig.Limits.Validate(); err != nil {
+		return nil, err
+	}
+	if httpClientConfig.ConversionWorkers < 0 {
+		return nil, errors.New("the number of conversion workers must not be negative")
+	}
+	if err := httpClientConfig.SeriesOrder.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &V2WriteRequestBuilder{
+		scopeMetricSlices: make(map[resourceID][]pmetric.Metric),
+		symbols:           NewSymbolsTable(),
+		request:           typesv2.Request{},
+		encoder:           snappyEncoder{},
+		httpClientConfig:  httpClientConfig,
+	}, nil
+}
 
-	resourceMetricsSlice := exportReq.Metrics().ResourceMetrics()
-	if resourceMetricsSlice.Len() == 0 {
+func NewV2RequestBuilder(exportReq pmetricotlp.ExportRequest, httpClientConfig httpClientConfig) (*V2WriteRequestBuilder, error) {
+	if exportReq.Metrics().ResourceMetrics().Len() == 0 {
 		return nil, fmt.Errorf("Invalid Request")
 	}
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	builder.Add(exportReq.Metrics())
+
+	return builder, nil
+}
+
+// Add queues the metrics for the next Build. They are only read by Build, so they must not
+// be modified in the meantime.
+func (builder *V2WriteRequestBuilder) Add(md pmetric.Metrics) {
+	resourceMetricsSlice := md.ResourceMetrics()
 	// This just makes one giant scopeMetricSlice per resource, instead of there being multiple
 	// scopeMetricSlices hidden inside each scope for the resource.
 	//
@@ -36,98 +89,221 @@ func NewV2RequestBuilder(exportReq pmetricotlp.ExportRequest, httpClientConfig h
 	// For the sake of this POC, I think that's fine.
 	for i := 0; i < resourceMetricsSlice.Len(); i++ {
 		resourceMetric := resourceMetricsSlice.At(i)
-		for j := 0; j < resourceMetricsSlice.At(i).ScopeMetrics().Len(); j++ {
+		id := builder.addResource(resourceMetric)
+
+		for j := 0; j < resourceMetric.ScopeMetrics().Len(); j++ {
 			scopeMetric := resourceMetric.ScopeMetrics().At(j)
 
 			for k := 0; k < scopeMetric.Metrics().Len(); k++ {
-				scopeMetricSlices[resourceID(i)] = append(scopeMetricSlices[resourceID(i)], scopeMetric.Metrics().At(k))
+				builder.scopeMetricSlices[id] = append(builder.scopeMetricSlices[id], scopeMetric.Metrics().At(k))
 			}
 		}
 	}
-
-	return &V2WriteRequestBuilder{
-		scopeMetricSlices: scopeMetricSlices,
-		resources:         resourceMetricsSlice,
-		symbols:           NewSymbolsTable(),
-		request:           typesv2.Request{},
-		httpClientConfig:  httpClientConfig,
-	}, nil
 }
 
-func (builder *V2WriteRequestBuilder) CreateRequest() {
-	var timeSeries []typesv2.TimeSeries
-	builder.makeTimeSeriesSlice()
+// addResource adds a resource along with the given metrics of its scopes.
+func (builder *V2WriteRequestBuilder) addResource(resource pmetric.ResourceMetrics, metrics ...pmetric.Metric) resourceID {
+	id := resourceID(len(builder.resources))
+	builder.resources = append(builder.resources, resource)
+	builder.scopeMetricSlices[id] = append(builder.scopeMetricSlices[id], metrics...)
+	return id
+}
 
-	for _, ts := range builder.tsSlice {
-		// Lets just consider histograms because thats what we generated.
-		switch ts.metric.Type() {
-		default:
-			ts.addNativeHistograms()
-		}
+// Reset forgets everything added so far. The memory of the previous builds is kept for the
+// next one.
+func (builder *V2WriteRequestBuilder) Reset() {
+	// Clear the references to the metrics so that they can be garbage collected.
+	clear(builder.resources)
+	builder.resources = builder.resources[:0]
+	for id, metrics := range builder.scopeMetricSlices {
+		clear(metrics)
+		builder.scopeMetricSlices[id] = metrics[:0]
+	}
+	builder.tsSlice = builder.tsSlice[:0]
+	builder.pointGroups.reset()
+	builder.symbols.Reset()
+	builder.request.Timeseries = builder.request.Timeseries[:0]
+	builder.request.Symbols = builder.symbols.symbols
+}
 
-		v2ts := typesv2.TimeSeries{
-			LabelsRefs:       ts.labelRef,
-			Metadata:         typesv2.Metadata{},
-			CreatedTimestamp: int64(time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))),
-			Histograms:       ts.histograms,
-		}
+// Build converts everything added since the last Reset into a single request. Data points
+// that can't be converted are left out and reported in the returned error, which aggregates
+// a *ConversionError per offending metric or point; see DroppedPoints.
+//
+// The request is backed by the builder: it is only valid until the next Build or Reset.
+func (builder *V2WriteRequestBuilder) Build() (*typesv2.Request, error) {
+	err := builder.convertAll(true)
 
+	timeSeries := builder.request.Timeseries[:0]
+	for _, ts := range builder.tsSlice {
+		v2ts := ts.toTimeSeries()
+		v2ts.LabelsRefs = ts.labelRef
 		timeSeries = append(timeSeries, v2ts)
 	}
+	// Don't keep the histograms of series left out of this build alive.
+	clear(timeSeries[len(timeSeries):cap(timeSeries)])
 
 	builder.request = typesv2.Request{
 		Symbols:    builder.symbols.symbols,
 		Timeseries: timeSeries,
 	}
+	if builder.httpClientConfig.CompactSymbols {
+		builder.compactor.compact(&builder.request, false)
+	}
+	return &builder.request, err
+}
+
+// RequestFromMetrics converts metrics into a single request, applying the label limits of
+// limits, without sending it anywhere. Like Build, it returns the request along with the
+// conversion errors of the metrics left out.
+func RequestFromMetrics(md pmetric.Metrics, limits RequestLimits) (*typesv2.Request, error) {
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{Limits: limits})
+	if err != nil {
+		return nil, err
+	}
+	builder.Add(md)
+	return builder.Build()
+}
+
+// CreateRequest builds the request like Build, for callers that don't care which metrics
+// could not be converted.
+func (builder *V2WriteRequestBuilder) CreateRequest() {
+	_, _ = builder.Build()
+}
+
+// Enqueue hands every series of the export request to the queue manager, which batches them
+// into requests of its own instead of the one monolithic request built by CreateRequest.
+// Metrics that can't be converted are reported like in Build.
+//
+// If a series can't be queued, because ctx is done or the queue manager is not running,
+// Enqueue returns that error, which is not a ConversionError, along with the conversion
+// errors: the series before it were queued, the others were not.
+//
+// The queue manager keeps the labels and histograms of the series until they are sent, so
+// the builder trades them for those of series sent before, which it reuses like in Build.
+func (builder *V2WriteRequestBuilder) Enqueue(ctx context.Context, qm *QueueManager) error {
+	err := builder.makeTimeSeriesSlice()
+
+	for _, ts := range builder.tsSlice {
+		p := pendingSeries{labels: ts.labelSet, series: ts.toTimeSeries()}
+		p.buffers = seriesBuffersPool.Get().(*seriesBuffers)
+		ts.labelSet, p.buffers.labels = p.buffers.labels[:0], ts.labelSet
+		ts.histograms, p.buffers.histograms = p.buffers.histograms[:0], ts.histograms
+		if appendErr := qm.append(ctx, p); appendErr != nil {
+			p.release()
+			return multierr.Append(err, fmt.Errorf("queueing series: %w", appendErr))
+		}
+	}
+	return err
+}
+
+// makeTimeSeriesSlice converts everything added into tsSlice.
+func (builder *V2WriteRequestBuilder) makeTimeSeriesSlice() error {
+	return builder.convertAll(false)
+}
+
+// convertAll converts everything added into tsSlice, in the order it was added, on several
+// goroutines for batches of many resources. If symbolize is set, the label references of
+// the series are generated in the symbols table of the builder too.
+//
+// With SeriesOrderLabels, the series are sorted by label set before being symbolized.
+func (builder *V2WriteRequestBuilder) convertAll(symbolize bool) error {
+	builder.tsSlice = builder.tsSlice[:0]
+	sorted := builder.httpClientConfig.SeriesOrder == SeriesOrderLabels
+	var err error
+	if workers := builder.conversionWorkers(); workers > 1 {
+		err = builder.convertParallel(workers, symbolize && !sorted)
+		if !sorted {
+			return err
+		}
+	} else {
+		err = builder.convert(builder.appendTS)
+	}
+
+	if sorted {
+		slices.SortStableFunc(builder.tsSlice, func(a, b *ts) int {
+			return compareLabels(a.labelSet, b.labelSet)
+		})
+	}
+	if symbolize {
+		builder.symbols.Reset()
+		for _, ts := range builder.tsSlice {
+			ts.generateLabelRefs(&builder.symbols)
+		}
+	}
+	return err
 }
 
+// convert converts everything added, in the order it was added, handing every series to
+// emit as soon as it is converted. Series obtained with nextTS are only kept if emit appends
+// them to tsSlice.
+//
 // neglecting scope attributes for now.
-func (builder *V2WriteRequestBuilder) makeTimeSeriesSlice() {
-	for resourceID, metricSlice := range builder.scopeMetricSlices {
+func (builder *V2WriteRequestBuilder) convert(emit func(ts *ts)) error {
+	var errs error
+	for i := range builder.resources {
+		resourceID := resourceID(i)
+		metricSlice := builder.scopeMetricSlices[resourceID]
 		// get the resource attributes as well and append it to the Timeseries
-		resourceAttrs := builder.resources.At(int(resourceID)).Resource().Attributes()
-		labels := getLabelsFromAttrs(resourceAttrs)
+		resourceAttrs := builder.resources[resourceID].Resource().Attributes()
+		builder.resourceLabels = appendLabelsFromAttrs(builder.resourceLabels[:0], resourceAttrs)
 
 		for i := 0; i < len(metricSlice); i++ {
 			metric := metricSlice[i]
 			switch metric.Type() {
 			case pmetric.MetricTypeExponentialHistogram:
 				dataPoints := metric.ExponentialHistogram().DataPoints()
-				labels = append(labels, getLabelsFromExpDataPoints(dataPoints)...)
-				builder.symbolizeLabels(labels)
-
-				// While we are at it, we can also create neat ts objects which will come
-				// in handy later.
-				ts := newTS(metric, labels)
-				ts.generateLabelRefs()
-				builder.appendTS(ts)
+				builder.pointGroups.group(dataPoints.Len(), func(i int) pcommon.Map { return dataPoints.At(i).Attributes() })
+				for g := range builder.pointGroups.groups {
+					attrs, points := builder.pointGroups.series(g)
+					ts := builder.nextTS(metric)
+					labels := appendSeriesLabels(ts.labelSet, builder.resourceLabels, metric.Name(), attrs)
+					// Keep the labels for the next use of ts, whatever happens to this one.
+					ts.labelSet = labels
+					labels, err := applyLabelLimits(labels, builder.httpClientConfig.Limits)
+					if err != nil {
+						errs = multierr.Append(errs, newConversionError(ReasonLabelTooLong, metric.Name(), len(points), "%v", err))
+						continue
+					}
+					if err := validateLabels(labels); err != nil {
+						errs = multierr.Append(errs, newConversionError(ReasonInvalidLabel, metric.Name(), len(points), "%v", err))
+						continue
+					}
+
+					// While we are at it, we can also fill neat ts objects which will come
+					// in handy later. Their label refs are generated once we know which symbols
+					// table they end up in.
+					errs = multierr.Append(errs, ts.addNativeHistograms(points))
+					if len(ts.histograms) == 0 {
+						continue
+					}
+					emit(ts)
+				}
 
 			default:
-				dataPoints := metric.ExponentialHistogram().DataPoints()
-				builder.symbolizeLabels(getLabelsFromExpDataPoints(dataPoints))
+				errs = multierr.Append(errs, newConversionError(ReasonUnsupportedMetricType, metric.Name(), dataPointCount(metric), "%v", metric.Type()))
 			}
 		}
 	}
+	return errs
 }
 
-func (builder *V2WriteRequestBuilder) appendTS(ts *ts) {
-	builder.tsSlice = append(builder.tsSlice, ts)
-}
-
-func (builder *V2WriteRequestBuilder) symbolizeLabels(labels []prompb.Label) {
-	for _, label := range labels {
-		builder.symbols.Symbolize(label.Name)
-		builder.symbols.Symbolize(label.Value)
+// nextTS returns an empty series of the metric, reusing the memory of the series that came
+// at the same place in a previous build if there is one. It only makes it into the build
+// once appended with appendTS.
+func (builder *V2WriteRequestBuilder) nextTS(metric pmetric.Metric) *ts {
+	n := len(builder.tsSlice)
+	if n < cap(builder.tsSlice) {
+		if ts := builder.tsSlice[:n+1][n]; ts != nil {
+			ts.reset(metric)
+			return ts
+		}
 	}
+	return newTS(metric, nil)
 }
 
-// Create a HTTP client with the HTTP Config
-func (builder *V2WriteRequestBuilder) createHTTPClient() {
-	builder.httpClient = "http-client"
-}
-
-// Send the request to a remote endpoint
-func (builder *V2WriteRequestBuilder) send() {
+func (builder *V2WriteRequestBuilder) appendTS(ts *ts) {
+	builder.tsSlice = append(builder.tsSlice, ts)
 }
 
 type ts struct {
@@ -135,6 +311,9 @@ type ts struct {
 	labelSet   []prompb.Label
 	labelRef   stack
 	histograms []typesv2.Histogram
+	// createdTimestamp is the start of a cumulative series, in milliseconds, and 0 for a
+	// delta one whose every point starts anew.
+	createdTimestamp int64
 }
 
 // Maybe we should just initialize an empty TS
@@ -145,31 +324,61 @@ func newTS(metric pmetric.Metric, labelSet []prompb.Label) *ts {
 	}
 }
 
-func (ts *ts) generateLabelRefs() {
-	labelRefStack := newStack()
-	offset := uint32(0)
+// reset empties the series, keeping its memory.
+func (ts *ts) reset(metric pmetric.Metric) {
+	ts.metric = metric
+	ts.labelSet = ts.labelSet[:0]
+	ts.labelRef = ts.labelRef[:0]
+	ts.histograms = ts.histograms[:0]
+	ts.createdTimestamp = 0
+}
 
-	for _, label := range ts.labelSet {
-		nameSymbol := packSymbol(uint32(len(label.Name)), offset)
-		labelRefStack.push(nameSymbol)
-		offset += uint32(32)
+func (ts *ts) generateLabelRefs(symbols *symbolsTable) {
+	ts.labelRef = appendLabelRefs(ts.labelRef[:0], symbols, ts.labelSet)
+}
 
-		valueSymbol := packSymbol(uint32(len(label.Value)), offset)
-		labelRefStack.push(valueSymbol)
-		offset += uint32(32)
+// toTimeSeries returns the converted data points of the series, leaving the label references
+// to the caller since they depend on the symbols table the series ends up in.
+func (ts *ts) toTimeSeries() typesv2.TimeSeries {
+	return typesv2.TimeSeries{
+		Metadata:         typesv2.Metadata{Type: ts.metricType()},
+		CreatedTimestamp: ts.createdTimestamp,
+		Histograms:       ts.histograms,
 	}
+}
 
-	ts.labelRef = labelRefStack
+// metricType is the Prometheus type of the series: cumulative histograms are histograms, and
+// delta ones, whose every point stands on its own, gauge histograms.
+func (ts *ts) metricType() typesv2.Metadata_MetricType {
+	switch ts.metric.ExponentialHistogram().AggregationTemporality() {
+	case pmetric.AggregationTemporalityCumulative:
+		return typesv2.Metadata_METRIC_TYPE_HISTOGRAM
+	case pmetric.AggregationTemporalityDelta:
+		return typesv2.Metadata_METRIC_TYPE_GAUGEHISTOGRAM
+	}
+	return typesv2.Metadata_METRIC_TYPE_UNSPECIFIED
 }
 
 // might need to change this again later.
-func (ts *ts) addNativeHistograms() {
-	var nativeHistograms []typesv2.Histogram
-	histogramDPs := ts.metric.ExponentialHistogram().DataPoints()
-	for j := 0; j < histogramDPs.Len(); j++ {
-		nativeHistograms = append(nativeHistograms, exponentialToNativeHistogram(histogramDPs.At(j)))
+// addNativeHistograms converts the given data points of the metric, those of the series.
+// Points that can't be represented as native histograms are skipped and reported.
+func (ts *ts) addNativeHistograms(points []int) error {
+	var errs error
+	nativeHistograms := ts.histograms[:0]
+	h := ts.metric.ExponentialHistogram()
+	histogramDPs := h.DataPoints()
+	if h.AggregationTemporality() == pmetric.AggregationTemporalityCumulative && len(points) > 0 {
+		ts.createdTimestamp = histogramDPs.At(points[0]).StartTimestamp().AsTime().UnixMilli()
+	}
+	for _, j := range points {
+		if err := validateExponentialHistogram(histogramDPs.At(j)); err != nil {
+			errs = multierr.Append(errs, newConversionError(ReasonInvalidHistogram, ts.metric.Name(), 1, "data point %d: %v", j, err))
+			continue
+		}
+		nativeHistograms = appendNativeHistogram(nativeHistograms, histogramDPs.At(j))
 	}
 	ts.histograms = nativeHistograms
+	return errs
 }
 
 type symbolsTable struct {
@@ -184,6 +393,13 @@ func NewSymbolsTable() symbolsTable {
 	}
 }
 
+// Reset empties the table, keeping its memory. The symbols returned before are overwritten.
+func (t *symbolsTable) Reset() {
+	clear(t.symbolRef)
+	t.symbolRef[""] = 0
+	t.symbols = append(t.symbols[:0], "")
+}
+
 func (t *symbolsTable) Symbolize(str string) uint32 {
 	if ref, ok := t.symbolRef[str]; ok {
 		return ref
@@ -194,19 +410,65 @@ func (t *symbolsTable) Symbolize(str string) uint32 {
 	return ref
 }
 
+// symbolizeLabelRefs adds the labels to the table and returns their references, name and
+// value alternating, as expected in LabelsRefs.
+func symbolizeLabelRefs(t *symbolsTable, labels []prompb.Label) []uint32 {
+	return appendLabelRefs(newStack(), t, labels)
+}
+
+// appendLabelRefs is symbolizeLabelRefs appending to refs.
+func appendLabelRefs(refs stack, t *symbolsTable, labels []prompb.Label) stack {
+	for _, label := range labels {
+		refs = refs.push(t.Symbolize(label.Name))
+		refs = refs.push(t.Symbolize(label.Value))
+	}
+	return refs
+}
+
 // Since the discussion related to encoding is still ongoing, we would benefit from decoupling the
 // encoder logic from the request builder.
 type encoder interface {
-	Encode()
-	Decode()
+	Encode(req *typesv2.Request) ([]byte, error)
+	Decode(data []byte) (*typesv2.Request, error)
 }
 
 type resourceID int
 
-type stack []uint32
+// SeriesOrder is the order of the series in the requests built. Either way, requests built
+// from the same metrics are identical, and so are their Symbols tables, which list the
+// symbols in the order the series first reference them.
+type SeriesOrder string
+
+const (
+	// SeriesOrderInput keeps the series in the order their resources and metrics were added.
+	SeriesOrderInput SeriesOrder = "input"
+	// SeriesOrderLabels sorts the series by label set, so that the same series come out in
+	// the same order whatever the order of the metrics.
+	SeriesOrderLabels SeriesOrder = "labels"
+)
+
+func (o SeriesOrder) Validate() error {
+	switch o {
+	case "", SeriesOrderInput, SeriesOrderLabels:
+		return nil
+	}
+	return fmt.Errorf("unknown series order %q, must be %q or %q", o, SeriesOrderInput, SeriesOrderLabels)
+}
 
-type httpClient string
-type httpClientConfig string
+// compareLabels compares two sorted label sets, label by label.
+func compareLabels(a, b []prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+type stack []uint32
 
 func newStack() stack {
 	return stack([]uint32{})
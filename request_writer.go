@@ -0,0 +1,144 @@
+package prometheusremotewritev2
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/prometheus/prompb"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// Tags of the Request fields, length delimited.
+const (
+	symbolsTag    = 4<<3 | 2
+	timeseriesTag = 5<<3 | 2
+)
+
+// symbolsChunkSize is how many bytes of symbols are buffered before being written out.
+const symbolsChunkSize = 32 << 10
+
+// RequestWriter encodes a request one series at a time, so that only the series being
+// written and the symbols table are held in memory instead of the whole request. Series are
+// written out as they come and the symbols table, which references are only complete once
+// every series is in, is appended by Close: protobuf doesn't care about the order of the
+// fields on the wire.
+//
+//	rw := NewRequestWriter(w, "gzip")
+//	for ... {
+//		rw.WriteSeries(labels, series)
+//	}
+//	err := rw.Close()
+//
+// The snappy block format mandated by the spec compresses the whole payload at once, so
+// the only compression available on the fly is gzip. Receivers implementing the spec only
+// accept snappy and reject gzip payloads; only receivers that also take Content-Encoding:
+// gzip, like NewHandler, can be sent the output of a RequestWriter. Nothing in this package
+// sends it: the exporter and the queue manager send snappy encoded requests.
+type RequestWriter struct {
+	w io.Writer
+	// zw compresses what is written to w, if asked to.
+	zw      *gzip.Writer
+	symbols symbolsTable
+	refs    stack
+	buf     []byte
+	series  int
+	// err is the first marshalling or write error, after which nothing is written anymore.
+	err error
+}
+
+// NewRequestWriter returns a writer of a request to w, compressed with compression: either
+// "gzip" or "identity" (or empty) for none. Neither is the snappy compression spec compliant
+// receivers expect, see RequestWriter.
+func NewRequestWriter(w io.Writer, compression string) (*RequestWriter, error) {
+	rw := &RequestWriter{w: w, symbols: NewSymbolsTable()}
+	switch compression {
+	case "", "identity":
+	case "gzip":
+		rw.zw = gzip.NewWriter(w)
+		rw.w = rw.zw
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	return rw, nil
+}
+
+// WriteSeries adds the labels to the symbols table, sets the label references of the series
+// and writes it out. The series can be reused once WriteSeries returns. Once a series could
+// not be marshalled or written, WriteSeries and Close return that error.
+func (rw *RequestWriter) WriteSeries(labels []prompb.Label, series typesv2.TimeSeries) error {
+	if rw.err != nil {
+		return rw.err
+	}
+	rw.refs = appendLabelRefs(rw.refs[:0], &rw.symbols, labels)
+	series.LabelsRefs = rw.refs
+
+	size := series.Size()
+	rw.buf = binary.AppendUvarint(append(rw.buf[:0], timeseriesTag), uint64(size))
+	start := len(rw.buf)
+	rw.buf = append(rw.buf, make([]byte, size)...)
+	if _, err := series.MarshalToSizedBuffer(rw.buf[start:]); err != nil {
+		rw.err = fmt.Errorf("marshalling series: %w", err)
+		return rw.err
+	}
+	if _, rw.err = rw.w.Write(rw.buf); rw.err != nil {
+		return rw.err
+	}
+	rw.series++
+	return nil
+}
+
+// Len is the number of series written so far.
+func (rw *RequestWriter) Len() int {
+	return rw.series
+}
+
+// Close completes the request with its symbols table and flushes the compression, if any.
+// It does not close the underlying writer.
+func (rw *RequestWriter) Close() error {
+	if rw.err != nil {
+		return rw.err
+	}
+	rw.buf = rw.buf[:0]
+	for _, symbol := range rw.symbols.symbols {
+		rw.buf = binary.AppendUvarint(append(rw.buf, symbolsTag), uint64(len(symbol)))
+		rw.buf = append(rw.buf, symbol...)
+		if len(rw.buf) >= symbolsChunkSize {
+			if _, rw.err = rw.w.Write(rw.buf); rw.err != nil {
+				return rw.err
+			}
+			rw.buf = rw.buf[:0]
+		}
+	}
+	if _, rw.err = rw.w.Write(rw.buf); rw.err != nil {
+		return rw.err
+	}
+	if rw.zw != nil {
+		rw.err = rw.zw.Close()
+	}
+	return rw.err
+}
+
+// Stream converts everything added since the last Reset like Build, but writes every series
+// to rw as soon as it is converted instead of building a request: a single series is held
+// in memory at a time. Close rw to complete the request. If a series can't be marshalled
+// or written, the series after it are not either and that error is returned instead of the
+// conversion errors; Close returns it too.
+func (builder *V2WriteRequestBuilder) Stream(rw *RequestWriter) error {
+	builder.tsSlice = builder.tsSlice[:0]
+	if cap(builder.tsSlice) == 0 {
+		// The series every metric is converted into, in turn.
+		builder.tsSlice = append(builder.tsSlice, &ts{})[:0]
+	}
+	var writeErr error
+	errs := builder.convert(func(ts *ts) {
+		if writeErr == nil {
+			writeErr = rw.WriteSeries(ts.labelSet, ts.toTimeSeries())
+		}
+	})
+	if writeErr != nil {
+		return fmt.Errorf("writing series: %w", writeErr)
+	}
+	return errs
+}
@@ -0,0 +1,94 @@
+package prometheusremotewritev2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+func streamWorkload(t *testing.T, workload int, compression string) []byte {
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+	require.NoError(t, err)
+	builder.Add(generateWorkload(t, workload))
+
+	var buf bytes.Buffer
+	rw, err := NewRequestWriter(&buf, compression)
+	require.NoError(t, err)
+	require.NoError(t, builder.Stream(rw))
+	require.NoError(t, rw.Close())
+	w := benchWorkloads[workload]
+	assert.Equal(t, w.resources*w.metrics, rw.Len())
+	return buf.Bytes()
+}
+
+func TestStreamMatchesBuild(t *testing.T) {
+	var streamed typesv2.Request
+	require.NoError(t, streamed.Unmarshal(streamWorkload(t, 1, "")))
+	built, err := RequestFromMetrics(generateWorkload(t, 1), RequestLimits{})
+	require.NoError(t, err)
+
+	diffs, err := DiffRequests(built, &streamed)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+	assert.Equal(t, built.Symbols, streamed.Symbols)
+}
+
+func TestStreamGzip(t *testing.T) {
+	zr, err := gzip.NewReader(bytes.NewReader(streamWorkload(t, 0, "gzip")))
+	require.NoError(t, err)
+	pBuf, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	var req typesv2.Request
+	require.NoError(t, req.Unmarshal(pBuf))
+	assert.Len(t, req.Timeseries, 10)
+
+	// The receiver takes gzip compressed requests as they are.
+	var received int
+	server := httptest.NewServer(NewHandler(ConsumerFunc(func(_ context.Context, reader *RequestReader) (WriteStats, error) {
+		received = reader.Len()
+		return RequestStats(reader), nil
+	})))
+	defer server.Close()
+	resp := post(t, server.URL, contentTypeV2, "gzip", streamWorkload(t, 0, "gzip"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, 10, received)
+}
+
+func TestNewRequestWriterRejectsUnknownCompression(t *testing.T) {
+	_, err := NewRequestWriter(io.Discard, "snappy")
+	assert.ErrorContains(t, err, "unsupported compression")
+}
+
+// failingWriter accepts n bytes, then fails.
+type failingWriter struct{ n int }
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, errWriteFailed
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestStreamWriteErrorIsSticky(t *testing.T) {
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{})
+	require.NoError(t, err)
+	builder.Add(generateWorkload(t, 0))
+
+	rw, err := NewRequestWriter(&failingWriter{n: 100}, "")
+	require.NoError(t, err)
+	assert.ErrorIs(t, builder.Stream(rw), errWriteFailed)
+	assert.Less(t, rw.Len(), 10)
+	assert.ErrorIs(t, rw.Close(), errWriteFailed)
+}
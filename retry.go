@@ -0,0 +1,213 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryConfig controls how a failed remote write is retried. The field names follow the
+// collector's configretry.BackOffConfig so the settings map one to one onto the exporter config.
+type RetryConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// InitialInterval is the time to wait after the first failure before retrying.
+	InitialInterval time.Duration `mapstructure:"initial_interval"`
+	// RandomizationFactor is the jitter applied to every interval, e.g. 0.5 means +/-50%.
+	RandomizationFactor float64 `mapstructure:"randomization_factor"`
+	// Multiplier is the factor by which the interval grows after each attempt.
+	Multiplier float64 `mapstructure:"multiplier"`
+	// MaxInterval caps the wait between two consecutive attempts.
+	MaxInterval time.Duration `mapstructure:"max_interval"`
+	// MaxElapsedTime caps the total time spent on a request, including waits.
+	// Zero means there is no limit.
+	MaxElapsedTime time.Duration `mapstructure:"max_elapsed_time"`
+}
+
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Enabled:             true,
+		InitialInterval:     50 * time.Millisecond,
+		RandomizationFactor: 0.5,
+		Multiplier:          1.5,
+		MaxInterval:         30 * time.Second,
+		MaxElapsedTime:      5 * time.Minute,
+	}
+}
+
+func (cfg RetryConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.InitialInterval <= 0 {
+		return errors.New("retry: initial interval must be positive")
+	}
+	if cfg.RandomizationFactor < 0 || cfg.RandomizationFactor > 1 {
+		return errors.New("retry: randomization factor must be within [0, 1]")
+	}
+	if cfg.Multiplier < 1 {
+		return errors.New("retry: multiplier must be at least 1")
+	}
+	if cfg.MaxInterval < cfg.InitialInterval {
+		return errors.New("retry: max interval must not be lower than the initial interval")
+	}
+	if cfg.MaxElapsedTime < 0 {
+		return errors.New("retry: max elapsed time must not be negative")
+	}
+	return nil
+}
+
+// backoff hands out the wait before each retry. It is not safe for concurrent use,
+// every request being retried gets its own.
+type backoff struct {
+	cfg      RetryConfig
+	interval time.Duration
+	rand     *rand.Rand
+}
+
+func newBackoff(cfg RetryConfig) *backoff {
+	return &backoff{
+		cfg:      cfg,
+		interval: cfg.InitialInterval,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *backoff) next() time.Duration {
+	delta := b.cfg.RandomizationFactor * float64(b.interval)
+	min := float64(b.interval) - delta
+	max := float64(b.interval) + delta
+	wait := time.Duration(min + b.rand.Float64()*(max-min+1))
+
+	if float64(b.interval) >= float64(b.cfg.MaxInterval)/b.cfg.Multiplier {
+		b.interval = b.cfg.MaxInterval
+	} else {
+		b.interval = time.Duration(float64(b.interval) * b.cfg.Multiplier)
+	}
+	return wait
+}
+
+// Attempt records the outcome of a single try at sending a request.
+type Attempt struct {
+	StatusCode int
+	Err        error
+	Duration   time.Duration
+	// Wait is the time slept after this attempt before the next one.
+	Wait time.Duration
+}
+
+func (a Attempt) String() string {
+	if a.StatusCode != 0 {
+		return fmt.Sprintf("status %d after %v: %v", a.StatusCode, a.Duration, a.Err)
+	}
+	return fmt.Sprintf("after %v: %v", a.Duration, a.Err)
+}
+
+// SendError is returned once a request could not be delivered. It carries every attempt
+// that was made so the caller can tell a flaky endpoint from a misconfigured one.
+type SendError struct {
+	Attempts []Attempt
+	// Retryable tells whether the last failure was recoverable, i.e. we only gave up
+	// because the retry budget ran out.
+	Retryable bool
+}
+
+func (e *SendError) Error() string {
+	history := make([]string, len(e.Attempts))
+	for i, a := range e.Attempts {
+		history[i] = fmt.Sprintf("#%d %v", i+1, a)
+	}
+	return fmt.Sprintf("remote write failed after %d attempt(s): [%s]", len(e.Attempts), strings.Join(history, "; "))
+}
+
+func (e *SendError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// recoverableError marks a failure that is worth another attempt.
+type recoverableError struct {
+	error
+	retryAfter time.Duration
+}
+
+func (e recoverableError) Unwrap() error {
+	return e.error
+}
+
+// classifyResponse maps the response of the remote endpoint to nil, a recoverableError
+// or a plain error that must not be retried.
+func classifyResponse(resp *http.Response, body string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err := fmt.Errorf("server returned HTTP status %s: %s", resp.Status, body)
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err, parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
+
+// parseRetryAfter reads both forms of the Retry-After header, delay in seconds and HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// retry calls fn until it succeeds, returns a non recoverable error or the retry budget
+// described by cfg is exhausted.
+func retry(ctx context.Context, cfg RetryConfig, fn func(ctx context.Context) (statusCode int, err error)) error {
+	var (
+		start    = time.Now()
+		b        = newBackoff(cfg)
+		attempts []Attempt
+	)
+
+	for {
+		attemptStart := time.Now()
+		statusCode, err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		attempts = append(attempts, Attempt{StatusCode: statusCode, Err: err, Duration: time.Since(attemptStart)})
+		last := &attempts[len(attempts)-1]
+
+		var recoverable recoverableError
+		if !errors.As(err, &recoverable) {
+			return &SendError{Attempts: attempts}
+		}
+		if !cfg.Enabled {
+			return &SendError{Attempts: attempts, Retryable: true}
+		}
+
+		wait := b.next()
+		if recoverable.retryAfter > wait {
+			wait = recoverable.retryAfter
+		}
+		if cfg.MaxElapsedTime > 0 && time.Since(start)+wait > cfg.MaxElapsedTime {
+			return &SendError{Attempts: attempts, Retryable: true}
+		}
+		last.Wait = wait
+
+		select {
+		case <-ctx.Done():
+			last.Err = fmt.Errorf("%w (gave up: %v)", err, ctx.Err())
+			return &SendError{Attempts: attempts, Retryable: true}
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRetryConfig() RetryConfig {
+	return RetryConfig{
+		Enabled:             true,
+		InitialInterval:     time.Millisecond,
+		RandomizationFactor: 0.5,
+		Multiplier:          2,
+		MaxInterval:         10 * time.Millisecond,
+		MaxElapsedTime:      time.Second,
+	}
+}
+
+// serverReplying answers with the given status codes in order and 204 once they are used up.
+func serverReplying(calls *int32, header http.Header, codes ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1))
+		if n > len(codes) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(codes[n-1])
+	}))
+}
+
+func TestSendRetriesRecoverableErrors(t *testing.T) {
+	var calls int32
+	server := serverReplying(&calls, nil, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusInternalServerError)
+	defer server.Close()
+
+	cfg := httpClientConfig{Endpoint: server.URL, Retry: testRetryConfig()}
+	err := sendEncoded(context.Background(), http.DefaultClient, cfg, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "5xx and 429 should be retried until success")
+}
+
+func TestSendDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := serverReplying(&calls, nil, http.StatusBadRequest)
+	defer server.Close()
+
+	cfg := httpClientConfig{Endpoint: server.URL, Retry: testRetryConfig()}
+	err := sendEncoded(context.Background(), http.DefaultClient, cfg, []byte("payload"))
+
+	var sendErr *SendError
+	assert.True(t, errors.As(err, &sendErr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "4xx other than 429 must not be retried")
+	assert.False(t, sendErr.Retryable)
+	assert.Equal(t, http.StatusBadRequest, sendErr.Attempts[0].StatusCode)
+}
+
+func TestSendHonorsRetryAfter(t *testing.T) {
+	var calls int32
+	header := http.Header{"Retry-After": []string{"1"}}
+	server := serverReplying(&calls, header, http.StatusTooManyRequests)
+	defer server.Close()
+
+	cfg := httpClientConfig{Endpoint: server.URL, Retry: testRetryConfig()}
+	cfg.Retry.MaxElapsedTime = 5 * time.Second
+
+	start := time.Now()
+	err := sendEncoded(context.Background(), http.DefaultClient, cfg, []byte("payload"))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "Retry-After should take precedence over a shorter backoff")
+}
+
+func TestSendGivesUpAfterMaxElapsedTime(t *testing.T) {
+	var calls int32
+	codes := make([]int, 1000)
+	for i := range codes {
+		codes[i] = http.StatusBadGateway
+	}
+	server := serverReplying(&calls, nil, codes...)
+	defer server.Close()
+
+	cfg := httpClientConfig{Endpoint: server.URL, Retry: testRetryConfig()}
+	cfg.Retry.MaxElapsedTime = 50 * time.Millisecond
+	err := sendEncoded(context.Background(), http.DefaultClient, cfg, []byte("payload"))
+
+	var sendErr *SendError
+	assert.True(t, errors.As(err, &sendErr))
+	assert.True(t, sendErr.Retryable)
+	assert.Greater(t, len(sendErr.Attempts), 1, "the attempt history should be kept")
+	for _, a := range sendErr.Attempts {
+		assert.Equal(t, http.StatusBadGateway, a.StatusCode)
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	cfg := testRetryConfig()
+	cfg.RandomizationFactor = 0
+	b := newBackoff(cfg)
+	for i := 0; i < 10; i++ {
+		assert.LessOrEqual(t, b.next(), cfg.MaxInterval+1)
+	}
+}
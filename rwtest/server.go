@@ -0,0 +1,251 @@
+// Package rwtest provides a fake remote write 2.0 receiver for tests.
+//
+// It does not depend on the exporter, so the exporter's own tests can use it too.
+package rwtest
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+const protoV2 = "io.prometheus.write.v2.Request"
+
+// Response scripts the reply to a request.
+type Response struct {
+	// StatusCode is the status to reply with, 204 No Content if zero. Requests are only
+	// accepted with a 2xx status.
+	StatusCode int
+	// Delay is how long to wait before replying.
+	Delay time.Duration
+	// RetryAfter is sent as the Retry-After header if set.
+	RetryAfter string
+}
+
+// Received is a request the server received, whatever it replied.
+type Received struct {
+	Request    *typesv2.Request
+	Header     http.Header
+	StatusCode int
+}
+
+// Series is a series of the accepted requests, its labels resolved.
+type Series struct {
+	Labels     labels.Labels
+	Samples    []typesv2.Sample
+	Histograms []typesv2.Histogram
+}
+
+// Server is an in-process remote write 2.0 receiver recording the requests it receives. It
+// replies with the scripted responses in order, then accepts everything.
+//
+//	srv := rwtest.NewServer()
+//	defer srv.Close()
+//	srv.Script(rwtest.Response{StatusCode: http.StatusTooManyRequests, RetryAfter: "1"})
+//	... send to srv.URL ...
+//	srv.AssertSample(t, labels.FromStrings("__name__", "up"), 1)
+type Server struct {
+	URL string
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	script   []Response
+	received []Received
+}
+
+func NewServer() *Server {
+	s := &Server{}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Script queues responses to reply with to the next requests, in order.
+func (s *Server) Script(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, responses...)
+}
+
+// Received returns every request received so far, decoded, with the status it got.
+// Requests that could not be decoded are answered with 415 or 400, not recorded, and don't
+// use up the script.
+func (s *Server) Received() []Received {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Received(nil), s.received...)
+}
+
+// Requests returns the requests accepted so far.
+func (s *Server) Requests() []*typesv2.Request {
+	var reqs []*typesv2.Request
+	for _, r := range s.Received() {
+		if r.StatusCode/100 == 2 {
+			reqs = append(reqs, r.Request)
+		}
+	}
+	return reqs
+}
+
+// Reset forgets the requests received and the responses left in the script.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = nil
+	s.received = nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/x-protobuf" || params["proto"] != protoV2 {
+		http.Error(w, fmt.Sprintf("unsupported Content-Type %q", r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+	req, err := decode(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	var resp Response
+	if len(s.script) > 0 {
+		resp, s.script = s.script[0], s.script[1:]
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusNoContent
+	}
+	s.received = append(s.received, Received{Request: req, Header: r.Header.Clone(), StatusCode: resp.StatusCode})
+	s.mu.Unlock()
+
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if resp.RetryAfter != "" {
+		w.Header().Set("Retry-After", resp.RetryAfter)
+	}
+	w.WriteHeader(resp.StatusCode)
+}
+
+func decode(body io.Reader) (*typesv2.Request, error) {
+	compressed, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	pBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing body: %w", err)
+	}
+	var req typesv2.Request
+	if err := req.Unmarshal(pBuf); err != nil {
+		return nil, fmt.Errorf("unmarshalling request: %w", err)
+	}
+	return &req, nil
+}
+
+// FindSeries returns the series of the accepted requests having all the given labels, one
+// per request they were found in. It fails t if a request references a symbol it does
+// not have.
+func (s *Server) FindSeries(t testing.TB, lbls labels.Labels) []Series {
+	t.Helper()
+	var found []Series
+	for i, req := range s.Requests() {
+		for j, ts := range req.Timeseries {
+			seriesLabels, err := resolveLabels(req.Symbols, ts.LabelsRefs)
+			if err != nil {
+				t.Fatalf("request %d, series %d: %v", i, j, err)
+			}
+			if hasLabels(seriesLabels, lbls) {
+				found = append(found, Series{Labels: seriesLabels, Samples: ts.Samples, Histograms: ts.Histograms})
+			}
+		}
+	}
+	return found
+}
+
+// AssertSeries checks that a series with all the given labels was received.
+func (s *Server) AssertSeries(t testing.TB, lbls labels.Labels) bool {
+	t.Helper()
+	if len(s.FindSeries(t, lbls)) == 0 {
+		t.Errorf("no series with labels %s received", lbls)
+		return false
+	}
+	return true
+}
+
+// AssertSample checks that a series with all the given labels was received with a sample
+// of the given value.
+func (s *Server) AssertSample(t testing.TB, lbls labels.Labels, value float64) bool {
+	t.Helper()
+	var values []float64
+	for _, series := range s.FindSeries(t, lbls) {
+		for _, sample := range series.Samples {
+			if sample.Value == value {
+				return true
+			}
+			values = append(values, sample.Value)
+		}
+	}
+	t.Errorf("no sample of value %g received for series with labels %s, got %v", value, lbls, values)
+	return false
+}
+
+// AssertHistogramSum checks that a series with all the given labels was received with a
+// histogram of the given sum.
+func (s *Server) AssertHistogramSum(t testing.TB, lbls labels.Labels, sum float64) bool {
+	t.Helper()
+	var sums []float64
+	for _, series := range s.FindSeries(t, lbls) {
+		for _, h := range series.Histograms {
+			if h.Sum == sum {
+				return true
+			}
+			sums = append(sums, h.Sum)
+		}
+	}
+	t.Errorf("no histogram of sum %g received for series with labels %s, got %v", sum, lbls, sums)
+	return false
+}
+
+func resolveLabels(symbols []string, refs []uint32) (labels.Labels, error) {
+	if len(refs)%2 != 0 {
+		return labels.EmptyLabels(), fmt.Errorf("odd number of label references: %d", len(refs))
+	}
+	b := labels.NewScratchBuilder(len(refs) / 2)
+	for i := 0; i < len(refs); i += 2 {
+		if int(refs[i]) >= len(symbols) || int(refs[i+1]) >= len(symbols) {
+			return labels.EmptyLabels(), fmt.Errorf("label references %d, %d out of bounds of %d symbols", refs[i], refs[i+1], len(symbols))
+		}
+		b.Add(symbols[refs[i]], symbols[refs[i+1]])
+	}
+	b.Sort()
+	return b.Labels(), nil
+}
+
+// hasLabels tells whether lbls has every label of subset.
+func hasLabels(lbls, subset labels.Labels) bool {
+	ok := true
+	subset.Range(func(l labels.Label) {
+		if lbls.Get(l.Name) != l.Value {
+			ok = false
+		}
+	})
+	return ok
+}
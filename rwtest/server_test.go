@@ -0,0 +1,103 @@
+package rwtest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+const contentTypeV2 = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+
+func post(t *testing.T, client *http.Client, url, contentType string, req *typesv2.Request) (*http.Response, error) {
+	pBuf, err := req.Marshal()
+	require.NoError(t, err)
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, pBuf)))
+	require.NoError(t, err)
+	httpReq.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(httpReq)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func upRequest(value float64) *typesv2.Request {
+	return &typesv2.Request{
+		Symbols: []string{"", "__name__", "up", "job", "api"},
+		Timeseries: []typesv2.TimeSeries{{
+			LabelsRefs: []uint32{1, 2, 3, 4},
+			Samples:    []typesv2.Sample{{Value: value, Timestamp: 1}},
+		}},
+	}
+}
+
+// failureRecorder records the failures of assertions expected to fail.
+type failureRecorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *failureRecorder) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestServerRecordsAndScriptsResponses(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Script(Response{StatusCode: http.StatusTooManyRequests, RetryAfter: "5"}, Response{StatusCode: http.StatusUnsupportedMediaType})
+
+	resp, err := post(t, http.DefaultClient, srv.URL, contentTypeV2, upRequest(1))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+
+	resp, err = post(t, http.DefaultClient, srv.URL, "application/x-protobuf", upRequest(2))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode, "a 1.0 request")
+	resp, err = post(t, http.DefaultClient, srv.URL, contentTypeV2, upRequest(2))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode, "the script was not used up by the 1.0 request")
+
+	resp, err = post(t, http.DefaultClient, srv.URL, contentTypeV2, upRequest(3))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Len(t, srv.Received(), 3)
+	require.Len(t, srv.Requests(), 1)
+	srv.AssertSeries(t, labels.FromStrings("job", "api"))
+	srv.AssertSample(t, labels.FromStrings("__name__", "up"), 3)
+
+	// Rejected requests don't count.
+	rec := &failureRecorder{TB: t}
+	assert.False(t, srv.AssertSample(rec, labels.FromStrings("__name__", "up"), 1))
+	assert.False(t, srv.AssertSeries(rec, labels.FromStrings("job", "other")))
+	assert.False(t, srv.AssertHistogramSum(rec, labels.FromStrings("__name__", "up"), 1))
+	assert.Len(t, rec.failures, 3)
+
+	srv.Reset()
+	assert.Empty(t, srv.Received())
+}
+
+func TestServerDelaysResponses(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Script(Response{Delay: time.Second})
+
+	_, err := post(t, &http.Client{Timeout: 50 * time.Millisecond}, srv.URL, contentTypeV2, upRequest(1))
+	assert.Error(t, err)
+
+	start := time.Now()
+	srv.Script(Response{Delay: 20 * time.Millisecond})
+	resp, err := post(t, http.DefaultClient, srv.URL, contentTypeV2, upRequest(1))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
@@ -0,0 +1,227 @@
+package prometheusremotewritev2
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/prometheus/common/model"
+	"go.uber.org/multierr"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// LabelLimitAction is what happens to a series with a label longer than allowed.
+type LabelLimitAction string
+
+const (
+	// LabelLimitTruncate cuts the label name or value down to the limit.
+	LabelLimitTruncate LabelLimitAction = "truncate"
+	// LabelLimitDrop drops the series.
+	LabelLimitDrop LabelLimitAction = "drop"
+)
+
+// RequestLimits bounds the requests sent to the endpoint. Zero means unlimited.
+type RequestLimits struct {
+	MaxSeries  int `mapstructure:"max_series"`
+	MaxSamples int `mapstructure:"max_samples"`
+	// MaxBytes bounds the marshalled protobuf. Snappy does not grow realistic payloads, so
+	// this bounds the request body as well.
+	MaxBytes int `mapstructure:"max_bytes"`
+	// MaxSymbolsBytes bounds the marshalled symbols table of a request.
+	MaxSymbolsBytes int `mapstructure:"max_symbols_bytes"`
+
+	MaxLabelNameLength  int `mapstructure:"max_label_name_length"`
+	MaxLabelValueLength int `mapstructure:"max_label_value_length"`
+	// LabelLimitAction applies to labels exceeding the lengths above, it defaults to truncate.
+	LabelLimitAction LabelLimitAction `mapstructure:"label_limit_action"`
+}
+
+func (l RequestLimits) Validate() error {
+	if l.MaxSeries < 0 || l.MaxSamples < 0 || l.MaxBytes < 0 || l.MaxSymbolsBytes < 0 ||
+		l.MaxLabelNameLength < 0 || l.MaxLabelValueLength < 0 {
+		return errors.New("limits must not be negative")
+	}
+	switch l.LabelLimitAction {
+	case "", LabelLimitTruncate, LabelLimitDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown label limit action %q", l.LabelLimitAction)
+}
+
+func (l RequestLimits) unlimited() bool {
+	return l.MaxSeries <= 0 && l.MaxSamples <= 0 && l.MaxBytes <= 0 && l.MaxSymbolsBytes <= 0
+}
+
+// splitRequest breaks req into requests that respect the limits. Each of them gets its own
+// symbols table that only holds the strings its series reference.
+//
+// A series that does not fit in a request on its own, by its bytes, symbols or samples, is
+// left out and reported in the returned error, which aggregates a *ConversionError per
+// series; the other series are returned. A reference out of the symbols table fails the whole request.
+func splitRequest(req *typesv2.Request, limits RequestLimits) ([]typesv2.Request, error) {
+	if limits.unlimited() {
+		return []typesv2.Request{*req}, nil
+	}
+
+	s := requestSplitter{limits: limits}
+	s.reset()
+	var errs error
+	for i := range req.Timeseries {
+		err := s.add(req.Symbols, req.Timeseries[i])
+		var convErr *ConversionError
+		if errors.As(err, &convErr) {
+			errs = multierr.Append(errs, err)
+		} else if err != nil {
+			return nil, fmt.Errorf("series %d: %w", i, err)
+		}
+	}
+	s.flush()
+	return s.requests, errs
+}
+
+type requestSplitter struct {
+	limits RequestLimits
+
+	symbols      symbolsTable
+	symbolsBytes int
+	series       []typesv2.TimeSeries
+	seriesBytes  int
+	samples      int
+
+	requests []typesv2.Request
+}
+
+func (s *requestSplitter) add(symbols []string, ts typesv2.TimeSeries) error {
+	samples := len(ts.Samples) + len(ts.Histograms)
+	if s.limits.MaxSamples > 0 && samples > s.limits.MaxSamples {
+		return newConversionError(ReasonSeriesTooLarge, seriesName(symbols, ts), samples,
+			"the series has %d samples, the limit is %d", samples, s.limits.MaxSamples)
+	}
+	if len(s.series) > 0 &&
+		(s.limits.MaxSeries > 0 && len(s.series)+1 > s.limits.MaxSeries ||
+			s.limits.MaxSamples > 0 && s.samples+samples > s.limits.MaxSamples) {
+		s.flush()
+	}
+
+	mark := len(s.symbols.symbols)
+	remapped, err := remapSeries(&s.symbols, symbols, ts)
+	if err != nil {
+		s.rollback(mark)
+		return err
+	}
+	symbolsBytes := s.symbolsBytes
+	for _, str := range s.symbols.symbols[mark:] {
+		symbolsBytes += repeatedFieldSize(len(str))
+	}
+	seriesBytes := repeatedFieldSize(remapped.Size())
+
+	if s.limits.MaxSymbolsBytes > 0 && symbolsBytes > s.limits.MaxSymbolsBytes {
+		s.rollback(mark)
+		if len(s.series) == 0 {
+			return newConversionError(ReasonSymbolOverflow, seriesName(symbols, ts), samples,
+				"the symbols of the series take %d bytes, the limit is %d", symbolsBytes, s.limits.MaxSymbolsBytes)
+		}
+		s.flush()
+		return s.add(symbols, ts)
+	}
+	if s.limits.MaxBytes > 0 && symbolsBytes+s.seriesBytes+seriesBytes > s.limits.MaxBytes {
+		s.rollback(mark)
+		if len(s.series) == 0 {
+			return newConversionError(ReasonSeriesTooLarge, seriesName(symbols, ts), samples,
+				"the series takes %d bytes, the limit is %d", symbolsBytes+seriesBytes, s.limits.MaxBytes)
+		}
+		s.flush()
+		return s.add(symbols, ts)
+	}
+
+	s.series = append(s.series, remapped)
+	s.symbolsBytes = symbolsBytes
+	s.seriesBytes += seriesBytes
+	s.samples += samples
+	return nil
+}
+
+func (s *requestSplitter) flush() {
+	if len(s.series) == 0 {
+		return
+	}
+	s.requests = append(s.requests, typesv2.Request{Symbols: s.symbols.symbols, Timeseries: s.series})
+	s.reset()
+}
+
+func (s *requestSplitter) reset() {
+	s.symbols = NewSymbolsTable()
+	s.symbolsBytes = repeatedFieldSize(0)
+	s.series, s.seriesBytes, s.samples = nil, 0, 0
+}
+
+// rollback forgets the symbols added after the first mark ones.
+func (s *requestSplitter) rollback(mark int) {
+	for _, str := range s.symbols.symbols[mark:] {
+		delete(s.symbols.symbolRef, str)
+	}
+	s.symbols.symbols = s.symbols.symbols[:mark]
+}
+
+// seriesName is the metric name of ts, if its label references are in bounds.
+func seriesName(symbols []string, ts typesv2.TimeSeries) string {
+	for i := 0; i+1 < len(ts.LabelsRefs); i += 2 {
+		name, value := ts.LabelsRefs[i], ts.LabelsRefs[i+1]
+		if int(name) < len(symbols) && int(value) < len(symbols) && symbols[name] == model.MetricNameLabel {
+			return symbols[value]
+		}
+	}
+	return ""
+}
+
+// remapSeries copies ts with every reference into symbols replaced by a reference into t.
+func remapSeries(t *symbolsTable, symbols []string, ts typesv2.TimeSeries) (typesv2.TimeSeries, error) {
+	remap := func(ref uint32) (uint32, error) {
+		if int(ref) >= len(symbols) {
+			return 0, fmt.Errorf("reference %d out of bounds of %d symbols", ref, len(symbols))
+		}
+		return t.Symbolize(symbols[ref]), nil
+	}
+	remapAll := func(refs []uint32) ([]uint32, error) {
+		out := make([]uint32, len(refs))
+		for i, ref := range refs {
+			var err error
+			if out[i], err = remap(ref); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	var err error
+	if ts.LabelsRefs, err = remapAll(ts.LabelsRefs); err != nil {
+		return ts, err
+	}
+	if ts.Metadata.HelpRef, err = remap(ts.Metadata.HelpRef); err != nil {
+		return ts, err
+	}
+	if ts.Metadata.UnitRef, err = remap(ts.Metadata.UnitRef); err != nil {
+		return ts, err
+	}
+	if len(ts.Exemplars) > 0 {
+		exemplars := make([]typesv2.Exemplar, len(ts.Exemplars))
+		for i, e := range ts.Exemplars {
+			if e.LabelsRefs, err = remapAll(e.LabelsRefs); err != nil {
+				return ts, err
+			}
+			exemplars[i] = e
+		}
+		ts.Exemplars = exemplars
+	}
+	return ts, nil
+}
+
+// repeatedFieldSize is the wire size of one element of a repeated length delimited field
+// with a field number below 16: tag, length and payload.
+func repeatedFieldSize(n int) int {
+	return 1 + sovSize(uint64(n)) + n
+}
+
+func sovSize(x uint64) int {
+	return (bits.Len64(x|1) + 6) / 7
+}
@@ -0,0 +1,131 @@
+package prometheusremotewritev2
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// requestWithSeries builds a request of n series sharing a "job" label, each with its own
+// "series" label and samplesPerSeries samples.
+func requestWithSeries(n, samplesPerSeries int) typesv2.Request {
+	symbols := NewSymbolsTable()
+	req := typesv2.Request{}
+	for i := 0; i < n; i++ {
+		labels := []prompb.Label{{Name: "job", Value: "test"}, {Name: "series", Value: fmt.Sprint(i)}}
+		ts := typesv2.TimeSeries{LabelsRefs: symbolizeLabelRefs(&symbols, labels)}
+		for j := 0; j < samplesPerSeries; j++ {
+			ts.Samples = append(ts.Samples, typesv2.Sample{Value: float64(j), Timestamp: int64(j)})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	req.Symbols = symbols.symbols
+	return req
+}
+
+// resolveSeries returns the label sets of every series of the requests, in order.
+func resolveSeries(requests ...typesv2.Request) []map[string]string {
+	var out []map[string]string
+	for _, req := range requests {
+		for _, ts := range req.Timeseries {
+			labels := map[string]string{}
+			for i := 0; i < len(ts.LabelsRefs); i += 2 {
+				labels[req.Symbols[ts.LabelsRefs[i]]] = req.Symbols[ts.LabelsRefs[i+1]]
+			}
+			out = append(out, labels)
+		}
+	}
+	return out
+}
+
+func TestSplitRequestByMaxSeriesAndSamples(t *testing.T) {
+	req := requestWithSeries(10, 3)
+
+	requests, err := splitRequest(&req, RequestLimits{MaxSeries: 4})
+	require.NoError(t, err)
+	assert.Len(t, requests, 3)
+	assert.Equal(t, resolveSeries(req), resolveSeries(requests...))
+
+	requests, err = splitRequest(&req, RequestLimits{MaxSamples: 7})
+	require.NoError(t, err)
+	assert.Len(t, requests, 5, "two series of three samples fit in seven")
+	assert.Equal(t, resolveSeries(req), resolveSeries(requests...))
+}
+
+func TestSplitRequestKeepsMinimalSymbols(t *testing.T) {
+	req := requestWithSeries(10, 1)
+
+	requests, err := splitRequest(&req, RequestLimits{MaxSeries: 1})
+	require.NoError(t, err)
+	for _, r := range requests {
+		assert.Equal(t, []string{"", "job", "test", "series"}, r.Symbols[:4])
+		assert.Len(t, r.Symbols, 5, "only the strings of the single series should be kept")
+	}
+}
+
+func TestSplitRequestByMaxBytes(t *testing.T) {
+	req := requestWithSeries(100, 10)
+	const maxBytes = 1024
+
+	requests, err := splitRequest(&req, RequestLimits{MaxBytes: maxBytes})
+	require.NoError(t, err)
+	assert.Greater(t, len(requests), 1)
+	for _, r := range requests {
+		assert.LessOrEqual(t, r.Size(), maxBytes)
+	}
+	assert.Equal(t, resolveSeries(req), resolveSeries(requests...))
+
+	_, err = splitRequest(&req, RequestLimits{MaxBytes: 32})
+	assert.ErrorIs(t, err, ErrSeriesTooLarge)
+}
+
+func TestSplitRequestDropsOnlyOversizedSeries(t *testing.T) {
+	req := requestWithSeries(5, 1)
+	big := req.Timeseries[2]
+	for j := 1; j < 100; j++ {
+		big.Samples = append(big.Samples, typesv2.Sample{Value: float64(j), Timestamp: int64(j)})
+	}
+	req.Timeseries[2] = big
+
+	expected := resolveSeries(req)
+	expected = append(expected[:2:2], expected[3:]...)
+	for _, limits := range []RequestLimits{{MaxBytes: 256}, {MaxSamples: 10}} {
+		requests, err := splitRequest(&req, limits)
+		assert.Equal(t, map[DropReason]int{ReasonSeriesTooLarge: 100}, DroppedPoints(err), "%+v", limits)
+		assert.Equal(t, expected, resolveSeries(requests...), "%+v", limits)
+	}
+}
+
+func TestSplitRequestRejectsDanglingRefs(t *testing.T) {
+	req := requestWithSeries(1, 1)
+	req.Timeseries[0].LabelsRefs[1] = uint32(len(req.Symbols))
+
+	_, err := splitRequest(&req, RequestLimits{MaxSeries: 1})
+	assert.Error(t, err)
+}
+
+func TestSplitRequestByMaxSymbolsBytes(t *testing.T) {
+	req := requestWithSeries(100, 1)
+	const maxSymbolsBytes = 64
+
+	requests, err := splitRequest(&req, RequestLimits{MaxSymbolsBytes: maxSymbolsBytes})
+	require.NoError(t, err)
+	assert.Greater(t, len(requests), 1)
+	for _, r := range requests {
+		size := 0
+		for _, s := range r.Symbols {
+			size += repeatedFieldSize(len(s))
+		}
+		assert.LessOrEqual(t, size, maxSymbolsBytes)
+	}
+	assert.Equal(t, resolveSeries(req), resolveSeries(requests...))
+
+	requests, err = splitRequest(&req, RequestLimits{MaxSymbolsBytes: 8})
+	assert.ErrorIs(t, err, ErrSymbolOverflow)
+	assert.Empty(t, requests)
+	assert.Equal(t, map[DropReason]int{ReasonSymbolOverflow: 100}, DroppedPoints(err))
+}
@@ -0,0 +1,146 @@
+package prometheusremotewritev2
+
+import (
+	"slices"
+
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// SymbolsCompaction reports what compacting the symbols table of a request saved.
+type SymbolsCompaction struct {
+	// Size is the size of the encoded request before and after compaction.
+	SizeBefore, SizeAfter int
+	// Dropped is the number of symbols no reference pointed to.
+	Dropped int
+	// RefsSaved is what the dropped symbols and the references, packed or not, take less
+	// after compaction. It is computed from the sizes of the varints, without encoding the
+	// request, so it leaves out the length prefixes of the messages holding the references,
+	// which may shrink as well.
+	RefsSaved int
+}
+
+// Saved is the number of bytes saved by compaction, before any compression.
+func (c SymbolsCompaction) Saved() int {
+	return c.SizeBefore - c.SizeAfter
+}
+
+// CompactSymbols reorders the symbols table of a request by number of references, the most
+// referenced first, drops the symbols nothing references, and remaps every label, help,
+// unit and exemplar reference accordingly. References are varints, so the most common ones
+// are then encoded in a single byte. The empty string stays first, and symbols referenced
+// as often keep their relative order, so that compaction is deterministic.
+func CompactSymbols(req *typesv2.Request) (SymbolsCompaction, error) {
+	if err := validateRequest(req); err != nil {
+		return SymbolsCompaction{}, err
+	}
+	var c symbolsCompactor
+	return c.compact(req, true), nil
+}
+
+// symbolsCompactor holds the scratch space of compactions, to be reused.
+type symbolsCompactor struct {
+	counts []int
+	// order lists the references by rank, remap gives the rank of every reference.
+	order   []uint32
+	remap   []uint32
+	symbols []string
+}
+
+// compact compacts the symbols table of a valid request, computing the sizes of the
+// request only if asked to.
+func (c *symbolsCompactor) compact(req *typesv2.Request, measure bool) SymbolsCompaction {
+	var stats SymbolsCompaction
+	if measure {
+		stats.SizeBefore = req.Size()
+	}
+
+	n := len(req.Symbols)
+	c.counts = append(c.counts[:0], make([]int, n)...)
+	forEachRef(req, func(ref *uint32) {
+		c.counts[*ref]++
+	})
+
+	c.order = c.order[:0]
+	for ref := 1; ref < n; ref++ {
+		if c.counts[ref] > 0 {
+			c.order = append(c.order, uint32(ref))
+		}
+	}
+	slices.SortStableFunc(c.order, func(a, b uint32) int {
+		return c.counts[b] - c.counts[a]
+	})
+
+	for ref := 1; ref < n; ref++ {
+		if c.counts[ref] == 0 {
+			stats.RefsSaved += repeatedFieldSize(len(req.Symbols[ref]))
+		}
+	}
+
+	c.remap = append(c.remap[:0], make([]uint32, n)...)
+	c.symbols = append(c.symbols[:0], req.Symbols...)
+	for rank, ref := range c.order {
+		c.remap[ref] = uint32(rank + 1)
+		req.Symbols[rank+1] = c.symbols[ref]
+	}
+	// Don't keep the dropped symbols alive in the spare capacity.
+	clear(req.Symbols[len(c.order)+1:])
+	req.Symbols = req.Symbols[:len(c.order)+1]
+	stats.RefsSaved += c.remapRefs(req)
+
+	stats.Dropped = n - len(req.Symbols)
+	if measure {
+		stats.SizeAfter = req.Size()
+	}
+	return stats
+}
+
+// remapRefs replaces every reference of the request by its rank and returns how many bytes
+// the references take less: the empty references of the metadata are left out of the wire,
+// but stay empty, and packed references have a length prefix.
+func (c *symbolsCompactor) remapRefs(req *typesv2.Request) int {
+	saved := 0
+	remapPacked := func(refs []uint32) {
+		before, after := 0, 0
+		for i, ref := range refs {
+			refs[i] = c.remap[ref]
+			before += sovSize(uint64(ref))
+			after += sovSize(uint64(refs[i]))
+		}
+		if len(refs) > 0 {
+			saved += before + sovSize(uint64(before)) - after - sovSize(uint64(after))
+		}
+	}
+	remap := func(ref *uint32) {
+		old := *ref
+		*ref = c.remap[old]
+		saved += sovSize(uint64(old)) - sovSize(uint64(*ref))
+	}
+
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		remapPacked(ts.LabelsRefs)
+		remap(&ts.Metadata.HelpRef)
+		remap(&ts.Metadata.UnitRef)
+		for j := range ts.Exemplars {
+			remapPacked(ts.Exemplars[j].LabelsRefs)
+		}
+	}
+	return saved
+}
+
+// forEachRef calls fn with every reference of the request to the symbols table.
+func forEachRef(req *typesv2.Request, fn func(ref *uint32)) {
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		for j := range ts.LabelsRefs {
+			fn(&ts.LabelsRefs[j])
+		}
+		fn(&ts.Metadata.HelpRef)
+		fn(&ts.Metadata.UnitRef)
+		for j := range ts.Exemplars {
+			for k := range ts.Exemplars[j].LabelsRefs {
+				fn(&ts.Exemplars[j].LabelsRefs[k])
+			}
+		}
+	}
+}
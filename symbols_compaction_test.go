@@ -0,0 +1,135 @@
+package prometheusremotewritev2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"prometheusrwexporter-demo/rwtest"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// cloneRequest deep copies a request by encoding it.
+func cloneRequest(t *testing.T, req *typesv2.Request) *typesv2.Request {
+	pBuf, err := req.Marshal()
+	require.NoError(t, err)
+	var clone typesv2.Request
+	require.NoError(t, clone.Unmarshal(pBuf))
+	return &clone
+}
+
+func TestCompactSymbols(t *testing.T) {
+	req := &typesv2.Request{
+		Symbols: []string{"", "__name__", "up", "job", "unused", "a", "b", "help", "trace_id", "00ff"},
+		Timeseries: []typesv2.TimeSeries{
+			{LabelsRefs: []uint32{1, 2, 3, 5}, Metadata: typesv2.Metadata{HelpRef: 7}},
+			{LabelsRefs: []uint32{1, 2, 3, 6}, Exemplars: []typesv2.Exemplar{{LabelsRefs: []uint32{8, 9}}}},
+			{LabelsRefs: []uint32{1, 5, 3, 6}},
+		},
+	}
+	before := cloneRequest(t, req)
+
+	stats, err := CompactSymbols(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "__name__", "job", "up", "a", "b", "help", "trace_id", "00ff"}, req.Symbols,
+		"symbols should be ordered by number of references, then by their previous order")
+	assert.Equal(t, []uint32{1, 3, 2, 4}, req.Timeseries[0].LabelsRefs)
+	assert.Equal(t, uint32(6), req.Timeseries[0].Metadata.HelpRef)
+	assert.Equal(t, []uint32{7, 8}, req.Timeseries[1].Exemplars[0].LabelsRefs)
+	assert.Equal(t, 1, stats.Dropped)
+	assert.Equal(t, before.Size(), stats.SizeBefore)
+	assert.Equal(t, req.Size(), stats.SizeAfter)
+	assert.Equal(t, stats.Saved(), stats.RefsSaved, "no length prefix of a series changes size")
+
+	diffs, err := DiffRequests(before, req)
+	require.NoError(t, err)
+	assert.Empty(t, diffs, "compaction must not change what the request means")
+}
+
+func TestCompactSymbolsSavesBytes(t *testing.T) {
+	// The names shared by every series come after the values of the first 200 series: their
+	// references take two bytes until compaction moves them to the front.
+	req := &typesv2.Request{Symbols: []string{""}}
+	for i := 0; i < 200; i++ {
+		req.Symbols = append(req.Symbols, fmt.Sprintf("value-%d", i))
+	}
+	req.Symbols = append(req.Symbols, "job", "api", "id")
+	for i := 0; i < 200; i++ {
+		req.Timeseries = append(req.Timeseries, typesv2.TimeSeries{LabelsRefs: []uint32{201, 202, 203, uint32(i + 1)}})
+	}
+	before := cloneRequest(t, req)
+
+	stats, err := CompactSymbols(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "job", "api", "id", "value-0"}, req.Symbols[:5])
+	assert.Positive(t, stats.Saved())
+	assert.Equal(t, stats.Saved(), stats.RefsSaved)
+	assert.Zero(t, stats.Dropped)
+
+	diffs, err := DiffRequests(before, req)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// Compacting again changes nothing.
+	stats, err = CompactSymbols(req)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Saved())
+	assert.Zero(t, stats.RefsSaved)
+}
+
+func TestCompactSymbolsRejectsInvalidRequests(t *testing.T) {
+	_, err := CompactSymbols(&typesv2.Request{
+		Symbols:    []string{"", "a"},
+		Timeseries: []typesv2.TimeSeries{{LabelsRefs: []uint32{1, 2}}},
+	})
+	assert.ErrorIs(t, err, ErrInvalidRequest)
+}
+
+func TestBuildCompactsSymbols(t *testing.T) {
+	md := generateWorkload(t, 1)
+	expected, err := RequestFromMetrics(md, RequestLimits{})
+	require.NoError(t, err)
+	_, err = CompactSymbols(expected)
+	require.NoError(t, err)
+
+	builder, err := NewV2WriteRequestBuilder(httpClientConfig{CompactSymbols: true})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		builder.Reset()
+		builder.Add(md)
+		req, err := builder.Build()
+		require.NoError(t, err)
+		assert.Equal(t, expected.Symbols, req.Symbols)
+		assert.Equal(t, expected.Timeseries, req.Timeseries)
+	}
+}
+
+func TestQueueManagerCompactsSymbols(t *testing.T) {
+	server := rwtest.NewServer()
+	defer server.Close()
+
+	cfg := testQueueConfig()
+	cfg.MinShards, cfg.MaxSamplesPerSend = 1, 10000
+	clientCfg := httpClientConfig{Endpoint: server.URL, CompactSymbols: true}
+	qm, err := NewQueueManager(cfg, clientCfg, zap.NewNop())
+	require.NoError(t, err)
+	qm.Start()
+
+	builder, err := NewV2WriteRequestBuilder(clientCfg)
+	require.NoError(t, err)
+	builder.Add(generateWorkload(t, 2))
+	require.NoError(t, builder.Enqueue(context.Background(), qm))
+	qm.Stop(context.Background())
+
+	assert.Positive(t, qm.SymbolBytesSaved())
+	series := 0
+	for _, req := range server.Requests() {
+		_, err := NewRequestReader(req)
+		require.NoError(t, err)
+		series += len(req.Timeseries)
+	}
+	assert.Equal(t, benchWorkloads[2].resources*benchWorkloads[2].metrics, series)
+}
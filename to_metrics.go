@@ -0,0 +1,270 @@
+package prometheusremotewritev2
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/multierr"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+const (
+	targetInfoMetric = "target_info"
+	jobLabel         = "job"
+	instanceLabel    = "instance"
+	traceIDLabel     = "trace_id"
+	spanIDLabel      = "span_id"
+
+	serviceNameKey       = "service.name"
+	serviceNamespaceKey  = "service.namespace"
+	serviceInstanceIDKey = "service.instance.id"
+)
+
+// RequestToMetrics converts a request into OTLP metrics, the reverse of V2WriteRequestBuilder.
+//
+// Series are grouped into resources by their job and instance labels, which become the
+// service.namespace, service.name and service.instance.id attributes; the labels of the
+// matching target_info series become the other resource attributes. Samples of counters
+// become monotonic cumulative sums and any other samples gauges. Native histograms become
+// exponential histograms, or explicit bucket histograms when they have custom buckets.
+// Exemplars are attached to the first point of their series not older than them.
+//
+// Like the conversion to a request, histograms that cannot be converted are reported as
+// ConversionErrors, aggregated with multierr, and the rest is converted anyway.
+func RequestToMetrics(req *typesv2.Request) (pmetric.Metrics, error) {
+	reader, err := NewRequestReader(req)
+	if err != nil {
+		return pmetric.Metrics{}, err
+	}
+	c := metricsConverter{
+		md:         pmetric.NewMetrics(),
+		targetInfo: map[resourceKey]labels.Labels{},
+		scopes:     map[resourceKey]pmetric.ScopeMetrics{},
+		metrics:    map[metricKey]pmetric.Metric{},
+	}
+	return c.md, c.convert(reader)
+}
+
+type resourceKey struct {
+	job, instance string
+}
+
+func resourceKeyOf(lbls labels.Labels) resourceKey {
+	return resourceKey{job: lbls.Get(jobLabel), instance: lbls.Get(instanceLabel)}
+}
+
+type metricKey struct {
+	resource resourceKey
+	name     string
+	typ      pmetric.MetricType
+}
+
+type metricsConverter struct {
+	md         pmetric.Metrics
+	targetInfo map[resourceKey]labels.Labels
+	scopes     map[resourceKey]pmetric.ScopeMetrics
+	metrics    map[metricKey]pmetric.Metric
+}
+
+func (c *metricsConverter) convert(reader *RequestReader) error {
+	// target_info may come after the series of its target, so collect it first.
+	for it := reader.Iterator(); it.Next(); {
+		series := it.At()
+		if series.Labels.Get(model.MetricNameLabel) == targetInfoMetric {
+			c.targetInfo[resourceKeyOf(series.Labels)] = series.Labels
+		}
+	}
+
+	var errs error
+	for it := reader.Iterator(); it.Next(); {
+		series := it.At()
+		if series.Labels.Get(model.MetricNameLabel) == targetInfoMetric {
+			continue
+		}
+		c.addSamples(series)
+		errs = multierr.Append(errs, c.addHistograms(series))
+	}
+	return errs
+}
+
+func (c *metricsConverter) addSamples(series Series) {
+	if len(series.Samples) == 0 {
+		return
+	}
+	var dps pmetric.NumberDataPointSlice
+	if series.Metadata.Type == typesv2.Metadata_METRIC_TYPE_COUNTER {
+		dps = c.metric(series, pmetric.MetricTypeSum).Sum().DataPoints()
+	} else {
+		dps = c.metric(series, pmetric.MetricTypeGauge).Gauge().DataPoints()
+	}
+
+	start := dps.Len()
+	timestamps := make([]int64, 0, len(series.Samples))
+	for _, s := range series.Samples {
+		dp := dps.AppendEmpty()
+		c.setAttributes(series, dp.Attributes())
+		dp.SetTimestamp(msToTimestamp(s.Timestamp))
+		if series.Metadata.Type == typesv2.Metadata_METRIC_TYPE_COUNTER {
+			dp.SetStartTimestamp(msToTimestamp(series.CreatedTimestamp))
+		}
+		dp.SetDoubleValue(s.Value)
+		if value.IsStaleNaN(s.Value) {
+			dp.SetFlags(pmetric.DefaultDataPointFlags.WithNoRecordedValue(true))
+		}
+		timestamps = append(timestamps, s.Timestamp)
+	}
+	addExemplars(series.Exemplars, timestamps, func(i int) pmetric.ExemplarSlice {
+		return dps.At(start + i).Exemplars()
+	})
+}
+
+func (c *metricsConverter) addHistograms(series Series) error {
+	var (
+		errs       error
+		timestamps []int64
+		exemplars  []pmetric.ExemplarSlice
+	)
+	name := series.Labels.Get(model.MetricNameLabel)
+	for _, h := range series.Histograms {
+		var err error
+		if h.Schema == customBucketsSchema {
+			dp := pmetric.NewHistogramDataPoint()
+			if err = customBucketsToExplicitHistogram(h, dp); err == nil {
+				dps := c.metric(series, pmetric.MetricTypeHistogram).Histogram().DataPoints()
+				dp.SetStartTimestamp(msToTimestamp(series.CreatedTimestamp))
+				c.setAttributes(series, dp.Attributes())
+				dp.MoveTo(dps.AppendEmpty())
+				exemplars = append(exemplars, dps.At(dps.Len()-1).Exemplars())
+			}
+		} else {
+			dp := pmetric.NewExponentialHistogramDataPoint()
+			if err = nativeToExponentialHistogram(h, dp); err == nil {
+				dps := c.metric(series, pmetric.MetricTypeExponentialHistogram).ExponentialHistogram().DataPoints()
+				dp.SetStartTimestamp(msToTimestamp(series.CreatedTimestamp))
+				c.setAttributes(series, dp.Attributes())
+				dp.MoveTo(dps.AppendEmpty())
+				exemplars = append(exemplars, dps.At(dps.Len()-1).Exemplars())
+			}
+		}
+		if err != nil {
+			errs = multierr.Append(errs, newConversionError(ReasonInvalidHistogram, name, 1, "%v", err))
+			continue
+		}
+		timestamps = append(timestamps, h.Timestamp)
+	}
+	// Exemplars of a series without samples belong to its histograms.
+	if len(series.Samples) == 0 {
+		addExemplars(series.Exemplars, timestamps, func(i int) pmetric.ExemplarSlice {
+			return exemplars[i]
+		})
+	}
+	return errs
+}
+
+// metric returns the metric of the series' name and type within the series' resource,
+// creating the metric, and the resource, on first use.
+func (c *metricsConverter) metric(series Series, typ pmetric.MetricType) pmetric.Metric {
+	key := metricKey{resource: resourceKeyOf(series.Labels), name: series.Labels.Get(model.MetricNameLabel), typ: typ}
+	if m, ok := c.metrics[key]; ok {
+		return m
+	}
+
+	m := c.scope(key.resource).Metrics().AppendEmpty()
+	m.SetName(key.name)
+	m.SetDescription(series.Metadata.Help)
+	m.SetUnit(series.Metadata.Unit)
+	switch typ {
+	case pmetric.MetricTypeGauge:
+		m.SetEmptyGauge()
+	case pmetric.MetricTypeSum:
+		m.SetEmptySum().SetIsMonotonic(true)
+		m.Sum().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	case pmetric.MetricTypeHistogram:
+		m.SetEmptyHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	case pmetric.MetricTypeExponentialHistogram:
+		m.SetEmptyExponentialHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	}
+	c.metrics[key] = m
+	return m
+}
+
+func (c *metricsConverter) scope(key resourceKey) pmetric.ScopeMetrics {
+	if sm, ok := c.scopes[key]; ok {
+		return sm
+	}
+
+	rm := c.md.ResourceMetrics().AppendEmpty()
+	attrs := rm.Resource().Attributes()
+	if namespace, name, ok := strings.Cut(key.job, "/"); ok {
+		attrs.PutStr(serviceNamespaceKey, namespace)
+		attrs.PutStr(serviceNameKey, name)
+	} else if key.job != "" {
+		attrs.PutStr(serviceNameKey, key.job)
+	}
+	if key.instance != "" {
+		attrs.PutStr(serviceInstanceIDKey, key.instance)
+	}
+	c.targetInfo[key].Range(func(l labels.Label) {
+		if l.Name != model.MetricNameLabel && l.Name != jobLabel && l.Name != instanceLabel {
+			attrs.PutStr(l.Name, l.Value)
+		}
+	})
+
+	sm := rm.ScopeMetrics().AppendEmpty()
+	c.scopes[key] = sm
+	return sm
+}
+
+// setAttributes sets the labels of the series, but those identifying the metric and its
+// resource, as the attributes of a data point.
+func (c *metricsConverter) setAttributes(series Series, attrs pcommon.Map) {
+	attrs.EnsureCapacity(series.Labels.Len())
+	series.Labels.Range(func(l labels.Label) {
+		if l.Name != model.MetricNameLabel && l.Name != jobLabel && l.Name != instanceLabel {
+			attrs.PutStr(l.Name, l.Value)
+		}
+	})
+}
+
+// addExemplars attaches every exemplar to the first point not older than it, or to the last
+// point, given the point timestamps in order.
+func addExemplars(exemplars []Exemplar, timestamps []int64, point func(i int) pmetric.ExemplarSlice) {
+	if len(timestamps) == 0 {
+		return
+	}
+	for _, e := range exemplars {
+		i := 0
+		for i < len(timestamps)-1 && timestamps[i] < e.Timestamp {
+			i++
+		}
+		dst := point(i).AppendEmpty()
+		dst.SetTimestamp(msToTimestamp(e.Timestamp))
+		dst.SetDoubleValue(e.Value)
+		e.Labels.Range(func(l labels.Label) {
+			var traceID pcommon.TraceID
+			var spanID pcommon.SpanID
+			switch {
+			case l.Name == traceIDLabel && decodeHexID(l.Value, traceID[:]):
+				dst.SetTraceID(traceID)
+			case l.Name == spanIDLabel && decodeHexID(l.Value, spanID[:]):
+				dst.SetSpanID(spanID)
+			default:
+				dst.FilteredAttributes().PutStr(l.Name, l.Value)
+			}
+		})
+	}
+}
+
+// decodeHexID decodes s into id if it is the hex encoding of an id of that size.
+func decodeHexID(s string, id []byte) bool {
+	if hex.DecodedLen(len(s)) != len(id) {
+		return false
+	}
+	_, err := hex.Decode(id, []byte(s))
+	return err == nil
+}
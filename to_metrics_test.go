@@ -0,0 +1,148 @@
+package prometheusremotewritev2
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+func TestRequestToMetrics(t *testing.T) {
+	symbols := NewSymbolsTable()
+	series := func(metricType typesv2.Metadata_MetricType, help string, labels ...string) typesv2.TimeSeries {
+		lbls := []prompb.Label{}
+		for i := 0; i < len(labels); i += 2 {
+			lbls = append(lbls, prompb.Label{Name: labels[i], Value: labels[i+1]})
+		}
+		return typesv2.TimeSeries{
+			LabelsRefs: symbolizeLabelRefs(&symbols, lbls),
+			Metadata:   typesv2.Metadata{Type: metricType, HelpRef: symbols.Symbolize(help)},
+		}
+	}
+
+	counter := series(typesv2.Metadata_METRIC_TYPE_COUNTER, "Requests.", "__name__", "requests_total", "job", "shop/api", "instance", "a:80", "code", "200")
+	counter.CreatedTimestamp = 500
+	counter.Samples = []typesv2.Sample{{Value: 1, Timestamp: 1000}, {Value: 3, Timestamp: 2000}}
+	counter.Exemplars = []typesv2.Exemplar{{
+		LabelsRefs: symbolizeLabelRefs(&symbols, []prompb.Label{{Name: "trace_id", Value: "0102030405060708090a0b0c0d0e0f10"}, {Name: "user", Value: "x"}}),
+		Value:      2,
+		Timestamp:  1500,
+	}}
+	gauge := series(typesv2.Metadata_METRIC_TYPE_GAUGE, "Temperature.", "__name__", "temperature", "job", "shop/api", "instance", "a:80")
+	gauge.Samples = []typesv2.Sample{{Value: math.Float64frombits(value.StaleNaN), Timestamp: 1000}}
+	targetInfo := series(typesv2.Metadata_METRIC_TYPE_GAUGE, "", "__name__", "target_info", "job", "shop/api", "instance", "a:80", "region", "eu")
+	targetInfo.Samples = []typesv2.Sample{{Value: 1, Timestamp: 1000}}
+	nativeHistogram := series(typesv2.Metadata_METRIC_TYPE_HISTOGRAM, "Latency.", "__name__", "latency", "job", "worker")
+	nativeHistogram.Histograms = []typesv2.Histogram{{
+		Count:         &typesv2.Histogram_CountInt{CountInt: 10},
+		Sum:           12.5,
+		Schema:        1,
+		ZeroThreshold: 0.001,
+		ZeroCount:     &typesv2.Histogram_ZeroCountInt{ZeroCountInt: 1},
+		// Buckets 0, 1 and 4, 5.
+		PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 2}, {Offset: 2, Length: 2}},
+		PositiveDeltas: []int64{1, 1, 1, -2},
+		NegativeSpans:  []typesv2.BucketSpan{{Offset: -1, Length: 1}},
+		NegativeDeltas: []int64{2},
+		Timestamp:      3000,
+	}}
+	customBuckets := series(typesv2.Metadata_METRIC_TYPE_HISTOGRAM, "", "__name__", "size", "job", "worker")
+	customBuckets.Histograms = []typesv2.Histogram{{
+		Count:          &typesv2.Histogram_CountFloat{CountFloat: 6},
+		Sum:            20,
+		Schema:         customBucketsSchema,
+		CustomValues:   []float64{1, 5, 10},
+		PositiveSpans:  []typesv2.BucketSpan{{Offset: 1, Length: 1}, {Offset: 1, Length: 1}},
+		PositiveCounts: []float64{4, 2},
+		Timestamp:      3000,
+	}}
+
+	req := typesv2.Request{Timeseries: []typesv2.TimeSeries{counter, gauge, nativeHistogram, customBuckets, targetInfo}}
+	req.Symbols = symbols.symbols
+
+	md, err := RequestToMetrics(&req)
+	require.NoError(t, err)
+	require.Equal(t, 2, md.ResourceMetrics().Len())
+
+	api := md.ResourceMetrics().At(0)
+	assert.Equal(t, map[string]any{
+		"service.namespace":   "shop",
+		"service.name":        "api",
+		"service.instance.id": "a:80",
+		"region":              "eu",
+	}, api.Resource().Attributes().AsRaw())
+	metrics := api.ScopeMetrics().At(0).Metrics()
+	require.Equal(t, 2, metrics.Len(), "target_info is not a metric of its own")
+
+	requests := metrics.At(0)
+	assert.Equal(t, "requests_total", requests.Name())
+	assert.Equal(t, "Requests.", requests.Description())
+	require.Equal(t, pmetric.MetricTypeSum, requests.Type())
+	assert.True(t, requests.Sum().IsMonotonic())
+	dps := requests.Sum().DataPoints()
+	require.Equal(t, 2, dps.Len())
+	assert.Equal(t, map[string]any{"code": "200"}, dps.At(0).Attributes().AsRaw())
+	assert.Equal(t, msToTimestamp(500), dps.At(1).StartTimestamp())
+	assert.Equal(t, 3.0, dps.At(1).DoubleValue())
+	assert.Equal(t, 0, dps.At(0).Exemplars().Len())
+	require.Equal(t, 1, dps.At(1).Exemplars().Len(), "the exemplar belongs to the first point not older than it")
+	exemplar := dps.At(1).Exemplars().At(0)
+	assert.Equal(t, pcommon.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, exemplar.TraceID())
+	assert.Equal(t, map[string]any{"user": "x"}, exemplar.FilteredAttributes().AsRaw())
+
+	temperature := metrics.At(1)
+	require.Equal(t, pmetric.MetricTypeGauge, temperature.Type())
+	assert.True(t, temperature.Gauge().DataPoints().At(0).Flags().NoRecordedValue(), "stale markers have no recorded value")
+
+	worker := md.ResourceMetrics().At(1)
+	assert.Equal(t, map[string]any{"service.name": "worker"}, worker.Resource().Attributes().AsRaw())
+	metrics = worker.ScopeMetrics().At(0).Metrics()
+	require.Equal(t, 2, metrics.Len())
+
+	require.Equal(t, pmetric.MetricTypeExponentialHistogram, metrics.At(0).Type())
+	exp := metrics.At(0).ExponentialHistogram().DataPoints().At(0)
+	assert.Equal(t, int32(1), exp.Scale())
+	assert.Equal(t, uint64(10), exp.Count())
+	assert.Equal(t, uint64(1), exp.ZeroCount())
+	assert.Equal(t, 0.001, exp.ZeroThreshold())
+	assert.Equal(t, int32(-1), exp.Positive().Offset())
+	assert.Equal(t, []uint64{1, 2, 0, 0, 3, 1}, exp.Positive().BucketCounts().AsRaw())
+	assert.Equal(t, int32(-2), exp.Negative().Offset())
+	assert.Equal(t, []uint64{2}, exp.Negative().BucketCounts().AsRaw())
+
+	require.Equal(t, pmetric.MetricTypeHistogram, metrics.At(1).Type())
+	explicit := metrics.At(1).Histogram().DataPoints().At(0)
+	assert.Equal(t, uint64(6), explicit.Count())
+	assert.Equal(t, []float64{1, 5, 10}, explicit.ExplicitBounds().AsRaw())
+	assert.Equal(t, []uint64{0, 4, 0, 2}, explicit.BucketCounts().AsRaw())
+}
+
+func TestRequestToMetricsReportsInvalidHistograms(t *testing.T) {
+	req := typesv2.Request{
+		Symbols: []string{"", "__name__", "latency"},
+		Timeseries: []typesv2.TimeSeries{{
+			LabelsRefs: []uint32{1, 2},
+			Histograms: []typesv2.Histogram{
+				{Schema: 9},
+				{Schema: 0, PositiveSpans: []typesv2.BucketSpan{{Length: 2}}, PositiveDeltas: []int64{1}},
+				{Schema: customBucketsSchema, CustomValues: []float64{1}, PositiveSpans: []typesv2.BucketSpan{{Offset: 2, Length: 1}}, PositiveDeltas: []int64{1}},
+				{Schema: 0, Count: &typesv2.Histogram_CountInt{CountInt: 1}, Timestamp: 1000},
+			},
+		}},
+	}
+
+	md, err := RequestToMetrics(&req)
+	assert.ErrorIs(t, err, ErrInvalidHistogram)
+	assert.Equal(t, map[DropReason]int{ReasonInvalidHistogram: 3}, DroppedPoints(err))
+	assert.Equal(t, 1, md.DataPointCount(), "the valid histogram is still converted")
+
+	req.Symbols[0] = "x"
+	_, err = RequestToMetrics(&req)
+	assert.ErrorIs(t, err, ErrInvalidRequest)
+}
@@ -0,0 +1,178 @@
+package prometheusremotewritev2
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+// familySuffixes are the suffixes of the series names of a metric family, along with the
+// types of the families having series with them.
+var familySuffixes = []struct {
+	suffix string
+	types  []prompb.MetricMetadata_MetricType
+}{
+	{"_total", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_COUNTER}},
+	{"_created", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_COUNTER, prompb.MetricMetadata_HISTOGRAM, prompb.MetricMetadata_SUMMARY}},
+	{"_bucket", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_HISTOGRAM, prompb.MetricMetadata_GAUGEHISTOGRAM}},
+	{"_sum", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_HISTOGRAM, prompb.MetricMetadata_SUMMARY}},
+	{"_count", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_HISTOGRAM, prompb.MetricMetadata_SUMMARY}},
+	{"_gsum", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_GAUGEHISTOGRAM}},
+	{"_gcount", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_GAUGEHISTOGRAM}},
+	{"_info", []prompb.MetricMetadata_MetricType{prompb.MetricMetadata_INFO}},
+}
+
+// TranslateV1Request converts a remote write 1.0 request into a 2.0 one. Label names and
+// values are interned into a symbols table, and the metadata, which 1.0 sends per metric
+// family, is set on every series of the family: the series named after the family, and
+// those named with the suffixes the family type has, like the _bucket, _sum and _count
+// series of a classic histogram.
+func TranslateV1Request(req *prompb.WriteRequest) *typesv2.Request {
+	families := make(map[string]prompb.MetricMetadata, len(req.Metadata))
+	for _, md := range req.Metadata {
+		families[md.MetricFamilyName] = md
+	}
+
+	symbols := NewSymbolsTable()
+	out := &typesv2.Request{Timeseries: make([]typesv2.TimeSeries, 0, len(req.Timeseries))}
+	for _, ts := range req.Timeseries {
+		series := typesv2.TimeSeries{
+			LabelsRefs: symbolizeLabelRefs(&symbols, ts.Labels),
+			Samples:    make([]typesv2.Sample, 0, len(ts.Samples)),
+		}
+		if md, ok := familyMetadata(families, metricName(ts.Labels)); ok {
+			series.Metadata = typesv2.Metadata{
+				Type:    typesv2.Metadata_MetricType(md.Type),
+				HelpRef: symbols.Symbolize(md.Help),
+				UnitRef: symbols.Symbolize(md.Unit),
+			}
+		}
+		for _, s := range ts.Samples {
+			series.Samples = append(series.Samples, typesv2.Sample{Value: s.Value, Timestamp: s.Timestamp})
+		}
+		for _, h := range ts.Histograms {
+			series.Histograms = append(series.Histograms, v1ToV2Histogram(h))
+		}
+		for _, e := range ts.Exemplars {
+			series.Exemplars = append(series.Exemplars, typesv2.Exemplar{
+				LabelsRefs: symbolizeLabelRefs(&symbols, e.Labels),
+				Value:      e.Value,
+				Timestamp:  e.Timestamp,
+			})
+		}
+		out.Timeseries = append(out.Timeseries, series)
+	}
+	out.Symbols = symbols.symbols
+	return out
+}
+
+func metricName(lbls []prompb.Label) string {
+	for _, l := range lbls {
+		if l.Name == model.MetricNameLabel {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// familyMetadata looks up the metadata of the family of the series named name.
+func familyMetadata(families map[string]prompb.MetricMetadata, name string) (prompb.MetricMetadata, bool) {
+	if md, ok := families[name]; ok {
+		return md, true
+	}
+	for _, fs := range familySuffixes {
+		family, ok := strings.CutSuffix(name, fs.suffix)
+		if !ok {
+			continue
+		}
+		if md, ok := families[family]; ok && slices.Contains(fs.types, md.Type) {
+			return md, true
+		}
+	}
+	return prompb.MetricMetadata{}, false
+}
+
+// v1ToV2Histogram converts a native histogram, which has the same layout in both versions.
+func v1ToV2Histogram(h prompb.Histogram) typesv2.Histogram {
+	out := typesv2.Histogram{
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		NegativeSpans:  v1ToV2Spans(h.NegativeSpans),
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveSpans:  v1ToV2Spans(h.PositiveSpans),
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+		ResetHint:      typesv2.Histogram_ResetHint(h.ResetHint),
+		Timestamp:      h.Timestamp,
+	}
+	switch c := h.Count.(type) {
+	case *prompb.Histogram_CountInt:
+		out.Count = &typesv2.Histogram_CountInt{CountInt: c.CountInt}
+	case *prompb.Histogram_CountFloat:
+		out.Count = &typesv2.Histogram_CountFloat{CountFloat: c.CountFloat}
+	}
+	switch c := h.ZeroCount.(type) {
+	case *prompb.Histogram_ZeroCountInt:
+		out.ZeroCount = &typesv2.Histogram_ZeroCountInt{ZeroCountInt: c.ZeroCountInt}
+	case *prompb.Histogram_ZeroCountFloat:
+		out.ZeroCount = &typesv2.Histogram_ZeroCountFloat{ZeroCountFloat: c.ZeroCountFloat}
+	}
+	return out
+}
+
+func v1ToV2Spans(spans []prompb.BucketSpan) []typesv2.BucketSpan {
+	if spans == nil {
+		return nil
+	}
+	out := make([]typesv2.BucketSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, typesv2.BucketSpan{Offset: s.Offset, Length: s.Length})
+	}
+	return out
+}
+
+// V2ToV1Histogram converts a native histogram back to remote write 1.0.
+func V2ToV1Histogram(h typesv2.Histogram) prompb.Histogram {
+	out := prompb.Histogram{
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		NegativeSpans:  v2ToV1Spans(h.NegativeSpans),
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveSpans:  v2ToV1Spans(h.PositiveSpans),
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+		ResetHint:      prompb.Histogram_ResetHint(h.ResetHint),
+		Timestamp:      h.Timestamp,
+	}
+	switch c := h.Count.(type) {
+	case *typesv2.Histogram_CountInt:
+		out.Count = &prompb.Histogram_CountInt{CountInt: c.CountInt}
+	case *typesv2.Histogram_CountFloat:
+		out.Count = &prompb.Histogram_CountFloat{CountFloat: c.CountFloat}
+	}
+	switch c := h.ZeroCount.(type) {
+	case *typesv2.Histogram_ZeroCountInt:
+		out.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: c.ZeroCountInt}
+	case *typesv2.Histogram_ZeroCountFloat:
+		out.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: c.ZeroCountFloat}
+	}
+	return out
+}
+
+func v2ToV1Spans(spans []typesv2.BucketSpan) []prompb.BucketSpan {
+	if spans == nil {
+		return nil
+	}
+	out := make([]prompb.BucketSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, prompb.BucketSpan{Offset: s.Offset, Length: s.Length})
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package prometheusremotewritev2
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	typesv2 "prometheusrwexporter-demo/types"
+)
+
+func TestTranslateV1RequestMetadataByFamily(t *testing.T) {
+	series := func(name string) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: name}, {Name: "job", Value: "api"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}
+	}
+	v1 := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			series("http_requests_total"),
+			series("latency_seconds_bucket"),
+			series("latency_seconds_sum"),
+			series("temperature"),
+			series("temperature_total"),
+			series("unknown"),
+		},
+		Metadata: []prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "http_requests", Help: "Requests."},
+			{Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "latency_seconds", Help: "Latency.", Unit: "seconds"},
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "temperature", Help: "Temperature."},
+		},
+	}
+
+	reader, err := NewRequestReader(TranslateV1Request(v1))
+	require.NoError(t, err)
+	var metadata []Metadata
+	for it := reader.Iterator(); it.Next(); {
+		metadata = append(metadata, it.At().Metadata)
+	}
+	assert.Equal(t, []Metadata{
+		{Type: typesv2.Metadata_METRIC_TYPE_COUNTER, Help: "Requests."},
+		{Type: typesv2.Metadata_METRIC_TYPE_HISTOGRAM, Help: "Latency.", Unit: "seconds"},
+		{Type: typesv2.Metadata_METRIC_TYPE_HISTOGRAM, Help: "Latency.", Unit: "seconds"},
+		{Type: typesv2.Metadata_METRIC_TYPE_GAUGE, Help: "Temperature."},
+		{}, // Gauges have no _total series.
+		{},
+	}, metadata)
+}
+
+func TestTranslateV1RequestHistograms(t *testing.T) {
+	v1 := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels: []prompb.Label{{Name: "__name__", Value: "latency"}},
+		Histograms: []prompb.Histogram{{
+			Count:          &prompb.Histogram_CountFloat{CountFloat: 5},
+			Sum:            7,
+			Schema:         2,
+			ZeroThreshold:  0.01,
+			ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 1},
+			NegativeSpans:  []prompb.BucketSpan{{Offset: -2, Length: 1}},
+			NegativeCounts: []float64{1},
+			PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 1}, {Offset: 3, Length: 1}},
+			PositiveCounts: []float64{2, 1},
+			ResetHint:      prompb.Histogram_GAUGE,
+			Timestamp:      1000,
+		}},
+	}}}
+
+	req := TranslateV1Request(v1)
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []typesv2.Histogram{{
+		Count:          &typesv2.Histogram_CountFloat{CountFloat: 5},
+		Sum:            7,
+		Schema:         2,
+		ZeroThreshold:  0.01,
+		ZeroCount:      &typesv2.Histogram_ZeroCountFloat{ZeroCountFloat: 1},
+		NegativeSpans:  []typesv2.BucketSpan{{Offset: -2, Length: 1}},
+		NegativeCounts: []float64{1},
+		PositiveSpans:  []typesv2.BucketSpan{{Offset: 0, Length: 1}, {Offset: 3, Length: 1}},
+		PositiveCounts: []float64{2, 1},
+		ResetHint:      typesv2.Histogram_RESET_HINT_GAUGE,
+		Timestamp:      1000,
+	}}, req.Timeseries[0].Histograms)
+}
+
+func TestV2ToV1HistogramRoundTrips(t *testing.T) {
+	for _, tc := range []struct {
+		h                prompb.Histogram
+		count, zeroCount float64
+	}{{
+		h: prompb.Histogram{
+			Count:          &prompb.Histogram_CountFloat{CountFloat: 5.5},
+			Sum:            7,
+			Schema:         2,
+			ZeroThreshold:  0.01,
+			ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 1.5},
+			NegativeSpans:  []prompb.BucketSpan{{Offset: -2, Length: 1}},
+			NegativeCounts: []float64{1},
+			PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 1}, {Offset: 3, Length: 1}},
+			PositiveCounts: []float64{2, 1},
+			ResetHint:      prompb.Histogram_GAUGE,
+			Timestamp:      1000,
+		},
+		count: 5.5, zeroCount: 1.5,
+	}, {
+		h: prompb.Histogram{
+			Count:          &prompb.Histogram_CountInt{CountInt: 4},
+			Sum:            3,
+			ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1},
+			PositiveSpans:  []prompb.BucketSpan{{Offset: 1, Length: 2}},
+			PositiveDeltas: []int64{2, -1},
+			Timestamp:      2000,
+		},
+		count: 4, zeroCount: 1,
+	}} {
+		v2 := v1ToV2Histogram(tc.h)
+		assert.Equal(t, tc.h, V2ToV1Histogram(v2))
+
+		count, zeroCount := HistogramCounts(v2)
+		assert.Equal(t, tc.count, count)
+		assert.Equal(t, tc.zeroCount, zeroCount)
+	}
+}